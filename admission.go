@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+	"lukechampine.com/blake3"
+)
+
+// admissionError is returned by swap_swap when an onion is turned away
+// before being queued. The code lets wallets tell the reasons apart.
+type admissionError struct {
+	code int
+	msg  string
+}
+
+func (e *admissionError) Error() string  { return e.msg }
+func (e *admissionError) ErrorCode() int { return e.code }
+
+var (
+	errRateLimited      = &admissionError{-32001, "rate limited"}
+	errQueueFull        = &admissionError{-32002, "onion queue is full"}
+	errInsufficientWork = &admissionError{-32003, "insufficient proof of work"}
+	errCoinTooYoung     = &admissionError{-32004, "coin has too few confirmations"}
+	errNotSynced        = &admissionError{-32006, "chain is not synced"}
+)
+
+// limiter is a token bucket holding up to burst tokens, refilled at
+// rate tokens per second.
+type limiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) allow(now time.Time, rate, burst float64) bool {
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens = min(burst, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// maxTrackedIPs bounds the per-IP limiters. Beyond it, the one used
+// least recently is forgotten.
+const maxTrackedIPs = 10_000
+
+type rateLimits struct {
+	mu     sync.Mutex
+	global limiter
+	perIP  map[string]*list.Element
+	lru    *list.List
+}
+
+// ipLimiter is an element of the LRU list, the most recently used first.
+type ipLimiter struct {
+	key string
+	limiter
+}
+
+func newRateLimits() *rateLimits {
+	return &rateLimits{perIP: map[string]*list.Element{}, lru: list.New()}
+}
+
+// clientKey is what a client is rate limited by. An IPv6 client can use
+// any address of its /64, so it is limited by that.
+func clientKey(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// allow takes a token for the client at addr, and one from the global
+// limit. Limits are given in requests per minute, where 0 disables them.
+func (rl *rateLimits) allow(addr string, perIP, global float64) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if perIP > 0 {
+		key := clientKey(addr)
+		e := rl.perIP[key]
+		if e == nil {
+			if rl.lru.Len() >= maxTrackedIPs {
+				delete(rl.perIP, rl.lru.Remove(rl.lru.Back()).(*ipLimiter).key)
+			}
+			e = rl.lru.PushFront(&ipLimiter{key: key})
+			rl.perIP[key] = e
+		} else {
+			rl.lru.MoveToFront(e)
+		}
+		if !e.Value.(*ipLimiter).allow(now, perIP/60, perIP) {
+			return false
+		}
+	}
+	return global <= 0 || rl.global.allow(now, global/60, global)
+}
+
+// checkWork verifies that blake3(owner_proof || nonce) has at least
+// the required number of leading zero bits. As the owner proof signs
+// the whole onion, the work can't be reused for another one.
+func checkWork(onion *onion.Onion, nonce uint64, difficulty int) bool {
+	h := blake3.New(32, nil)
+	h.Write(onion.OwnerProof)
+	binary.Write(h, binary.BigEndian, nonce)
+	hash := h.Sum(nil)
+
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+var (
+	mwebCoinDBBucket = []byte("mweb-coindb")
+	mwebCoinsBucket  = []byte("coins")
+)
+
+// coinHeight returns the height of the block that created a coin. The
+// coin DB only exposes it by leaf index, so it is read from neutrino's
+// own bucket, where each coin is stored after its height. The layout is
+// that of the neutrino version pinned in go.mod, which TestCoinHeight
+// checks against neutrino's coin store.
+func coinHeight(db walletdb.DB, outputId *chainhash.Hash) (height int32, err error) {
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		root := tx.ReadBucket(mwebCoinDBBucket)
+		if root == nil || root.NestedReadBucket(mwebCoinsBucket) == nil {
+			return errors.New("mweb coin DB not found")
+		}
+		v := root.NestedReadBucket(mwebCoinsBucket).Get(outputId[:])
+		if len(v) < 4 {
+			return mwebdb.ErrCoinNotFound
+		}
+		return binary.Read(bytes.NewReader(v), binary.LittleEndian, &height)
+	})
+	return
+}
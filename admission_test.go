@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+)
+
+func TestRateLimits(t *testing.T) {
+	rl := newRateLimits()
+	for i := range 5 {
+		if !rl.allow("1.2.3.4:1000", 5, 8) {
+			t.Fatal("rejected request", i)
+		}
+	}
+	if rl.allow("1.2.3.4:2000", 5, 8) {
+		t.Fatal("per-IP limit not applied")
+	}
+	for i := range 3 {
+		if !rl.allow("5.6.7.8:1000", 5, 8) {
+			t.Fatal("rejected request", i)
+		}
+	}
+	if rl.allow("9.9.9.9:1000", 5, 8) {
+		t.Fatal("global limit not applied")
+	}
+	if !newRateLimits().allow("1.2.3.4:1000", 0, 0) {
+		t.Fatal("rejected with limits disabled")
+	}
+}
+
+func TestRateLimitsEviction(t *testing.T) {
+	rl := newRateLimits()
+	for i := range maxTrackedIPs + 10 {
+		rl.allow(fmt.Sprintf("10.%d.%d.%d:1000", i>>16, i>>8&0xff, i&0xff), 5, 0)
+	}
+	if len(rl.perIP) > maxTrackedIPs || rl.lru.Len() != len(rl.perIP) {
+		t.Fatal("tracked IPs not bounded", len(rl.perIP))
+	}
+	if _, ok := rl.perIP["10.0.0.0"]; ok {
+		t.Fatal("least recently used IP not evicted")
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	for addr, key := range map[string]string{
+		"1.2.3.4:1000":                "1.2.3.4",
+		"[2001:db8:1:2:3:4:5:6]:1000": "2001:db8:1:2::/64",
+		"[2001:db8:1:2:ffff::1]:2000": "2001:db8:1:2::/64",
+		"[::ffff:1.2.3.4]:1000":       "::ffff:1.2.3.4",
+	} {
+		if k := clientKey(addr); k != key {
+			t.Fatal(addr, k)
+		}
+	}
+
+	rl := newRateLimits()
+	for i := range 5 {
+		rl.allow(fmt.Sprintf("[2001:db8::%x]:1000", i+1), 5, 0)
+	}
+	if rl.allow("[2001:db8::ff]:1000", 5, 0) {
+		t.Fatal("per-IP limit bypassed within a /64")
+	}
+}
+
+// TestCoinHeight checks coinHeight against neutrino's own coin store, as
+// it reads the store's layout directly.
+func TestCoinHeight(t *testing.T) {
+	db := testDB(t)
+	store, err := mwebdb.NewCoinStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, o := testOnion(t)
+	hop, _, err := o.Onion.Peel(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputId := hop.Output.Hash()
+	err = store.PutCoins([]*wire.MwebNetUtxo{{
+		Height: 123, Output: hop.Output, OutputId: outputId}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if height, err := coinHeight(db, outputId); err != nil || height != 123 {
+		t.Fatal(height, err)
+	}
+	if _, err = coinHeight(db, &chainhash.Hash{}); !errors.Is(err, mwebdb.ErrCoinNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWork(t *testing.T) {
+	o := &onion.Onion{OwnerProof: make([]byte, 64)}
+	var nonce uint64
+	for !checkWork(o, nonce, 12) {
+		nonce++
+	}
+	if checkWork(o, nonce, 40) {
+		t.Fatal("work exceeds difficulty")
+	}
+}
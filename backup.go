@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// exportedOnion is a queued onion as written to a backup file.
+type exportedOnion struct {
+	Onion     *onion.Onion `json:"onion"`
+	Submitted uint64       `json:"submitted"`
+	Expiry    uint64       `json:"expiry,omitempty"`
+}
+
+// sealedBackup is a backup file encrypted to the operator's X25519 key.
+type sealedBackup struct {
+	PubKey     []byte `json:"ephemeral_xpub"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func backupAEAD(privKey *ecdh.PrivateKey, pubKey *ecdh.PublicKey) (cipher.AEAD, error) {
+	secret, err := privKey.ECDH(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, []byte("MWIXNET-BACKUP"))
+	h.Write(secret)
+	return chacha20poly1305.New(h.Sum(nil))
+}
+
+// encodeBackup serializes the onions, encrypting them if pubKey is set.
+// Each backup uses a fresh ephemeral key, so a zero nonce is safe.
+func encodeBackup(onions []*queuedOnion, pubKey *ecdh.PublicKey) ([]byte, error) {
+	exported := []*exportedOnion{}
+	for _, q := range onions {
+		exported = append(exported, &exportedOnion{
+			Onion:     q.Onion,
+			Submitted: unixTime(q.Submitted),
+			Expiry:    unixTime(q.Expiry),
+		})
+	}
+	data, err := json.MarshalIndent(exported, "", "  ")
+	if err != nil || pubKey == nil {
+		return data, err
+	}
+
+	ephKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := backupAEAD(ephKey, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&sealedBackup{
+		PubKey:     ephKey.PublicKey().Bytes(),
+		Ciphertext: aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), data, nil),
+	})
+}
+
+// decodeBackup parses a backup file, decrypting it if privKey is set.
+func decodeBackup(data []byte, privKey *ecdh.PrivateKey) ([]*queuedOnion, error) {
+	if privKey != nil {
+		var sealed sealedBackup
+		if err := json.Unmarshal(data, &sealed); err != nil {
+			return nil, err
+		}
+		pubKey, err := ecdh.X25519().NewPublicKey(sealed.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := backupAEAD(privKey, pubKey)
+		if err != nil {
+			return nil, err
+		}
+		data, err = aead.Open(nil, make([]byte, chacha20poly1305.NonceSize),
+			sealed.Ciphertext, nil)
+		if err != nil {
+			return nil, errors.New("backup decryption failed")
+		}
+	}
+
+	var exported []*exportedOnion
+	if err := json.Unmarshal(data, &exported); err != nil {
+		return nil, err
+	}
+	var onions []*queuedOnion
+	for _, e := range exported {
+		if e.Onion == nil {
+			return nil, errors.New("backup entry without onion")
+		}
+		onions = append(onions, &queuedOnion{
+			Onion:     e.Onion,
+			Submitted: fromUnixTime(e.Submitted),
+			Expiry:    fromUnixTime(e.Expiry),
+		})
+	}
+	return onions, nil
+}
+
+func exportOnions(path string, pubKey *ecdh.PublicKey) error {
+	onions, err := loadOnions(db)
+	if err != nil {
+		return err
+	}
+	data, err := encodeBackup(onions, pubKey)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	fmt.Println("Exported", len(onions), "onions to", path)
+	return nil
+}
+
+// importOnions queues the onions from a backup, keeping their original
+// submission times.
+func (s *swapService) importOnions(path string, privKey *ecdh.PrivateKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	onions, err := decodeBackup(data, privKey)
+	if err != nil {
+		return err
+	}
+	imported, skipped, err := s.queueOnions(onions, validateOnion)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Imported", imported, "onions from", path, "skipped", skipped)
+	return nil
+}
+
+// queueOnions saves the imported onions, subject to -max-queue and the
+// admission policies as if they had been submitted. Onions that are
+// already queued, have expired or no longer validate (e.g. their input
+// was spent) are skipped. Those failing transiently are kept, as a node
+// restored from a backup is likely still catching up with the chain;
+// the policies are left to check them when a round starts.
+func (s *swapService) queueOnions(onions []*queuedOnion,
+	validate func(*onion.Onion) error) (imported, skipped int, err error) {
+
+	for _, q := range onions {
+		if q.Submitted.IsZero() {
+			q.Submitted = time.Now()
+		}
+		found, err := hasOnion(db, q.Input.Commitment)
+		if err != nil {
+			return 0, 0, err
+		}
+		var reason error
+		switch {
+		case found:
+			reason = errors.New("already queued")
+		case q.expired(time.Now()):
+			reason = errors.New("expired")
+		default:
+			reason = s.checkImport(q, validate)
+		}
+		if errors.Is(reason, errCoinLookup) {
+			return 0, 0, reason
+		}
+		if reason != nil {
+			fmt.Printf("Skipping onion %x: %v\n", q.Input.Commitment, reason)
+			skipped++
+			continue
+		}
+		if err = saveOnion(db, q); err != nil {
+			return 0, 0, err
+		}
+		imported++
+	}
+	return
+}
+
+func (s *swapService) checkImport(q *queuedOnion, validate func(*onion.Onion) error) error {
+	if err := checkQueue(); err != nil {
+		return err
+	}
+	err := validate(q.Onion)
+	if isTransient(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.policy.Admit(context.Background(), q.Onion)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+)
+
+func TestBackup(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	onions := []*queuedOnion{
+		{Onion: testSignedOnion(t), Submitted: now},
+		{Onion: testSignedOnion(t), Submitted: now, Expiry: now.Add(time.Hour)},
+	}
+	operatorKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	otherKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	for _, key := range []*ecdh.PrivateKey{nil, operatorKey} {
+		var pubKey *ecdh.PublicKey
+		if key != nil {
+			pubKey = key.PublicKey()
+		}
+		data, err := encodeBackup(onions, pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		onions2, err := decodeBackup(data, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(onions2) != len(onions) {
+			t.Fatal("onion count mismatch")
+		}
+		for i, q := range onions2 {
+			if !bytes.Equal(q.Payloads, onions[i].Payloads) || !q.VerifySig() ||
+				!q.Submitted.Equal(onions[i].Submitted) ||
+				!q.Expiry.Equal(onions[i].Expiry) {
+				t.Fatal("onion mismatch", i)
+			}
+		}
+		if key != nil {
+			if _, err = decodeBackup(data, otherKey); err == nil {
+				t.Fatal("decrypted with the wrong key")
+			}
+		}
+	}
+}
+
+func TestQueueOnions(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	defer func(n int) { *maxQueued = n }(*maxQueued)
+	*maxQueued = 3
+
+	now := time.Now()
+	newOnion := func() *queuedOnion {
+		return &queuedOnion{Onion: testSignedOnion(t), Submitted: now}
+	}
+	queued := newOnion()
+	if err := saveOnion(db, queued); err != nil {
+		t.Fatal(err)
+	}
+	transient, spent, denied, valid, overflow := newOnion(), newOnion(),
+		newOnion(), newOnion(), newOnion()
+	expired := newOnion()
+	expired.Expiry = now.Add(-time.Second)
+
+	s := &swapService{policy: policies{denyPolicy{
+		chainhash.Hash(denied.Input.OutputId): true}}}
+	imported, skipped, err := s.queueOnions([]*queuedOnion{
+		queued, transient, spent, expired, denied, valid, overflow,
+	}, func(o *onion.Onion) error {
+		switch o {
+		case transient.Onion:
+			return transientError{errors.New("coin missing")}
+		case spent.Onion:
+			return errors.New("input spent")
+		}
+		return nil
+	})
+	if err != nil || imported != 2 || skipped != 5 {
+		t.Fatal(imported, skipped, err)
+	}
+	for _, q := range []*queuedOnion{queued, transient, valid} {
+		if found, err := hasOnion(db, q.Input.Commitment); err != nil || !found {
+			t.Fatal("onion not queued", err)
+		}
+	}
+	for _, q := range []*queuedOnion{spent, denied, overflow} {
+		if found, _ := hasOnion(db, q.Input.Commitment); found {
+			t.Fatal("onion queued")
+		}
+	}
+}
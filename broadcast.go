@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino"
+	"github.com/ltcmweb/neutrino/blockntfns"
+	"github.com/ltcmweb/neutrino/mwebdb"
+	"github.com/ltcmweb/neutrino/pushtx"
+)
+
+const (
+	txPending   = "pending"
+	txConfirmed = "confirmed"
+	txFailed    = "failed"
+
+	rebroadcastInterval = 10 * time.Minute
+	txExpiry            = 24 * time.Hour
+	maxWatchBackoff     = 5 * time.Minute
+)
+
+type txRecord struct {
+	Hash     chainhash.Hash `json:"hash"`
+	Tx       []byte         `json:"-"`
+	Status   string         `json:"status"`
+	Sent     time.Time      `json:"sent"`
+	LastSent time.Time      `json:"last_sent"`
+	Height   uint32         `json:"height,omitempty"`
+	Reason   string         `json:"reason,omitempty"`
+
+	// SentHeight is the tip when the tx was sent, from which its
+	// kernel is looked for.
+	SentHeight uint32 `json:"sent_height"`
+}
+
+func (r *txRecord) msgTx() (*wire.MsgTx, error) {
+	tx := &wire.MsgTx{}
+	if err := tx.Deserialize(bytes.NewReader(r.Tx)); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (s *swapService) broadcast(tx *wire.MsgTx) error {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return err
+	}
+	_, height, err := cs.BlockHeaders.ChainTip()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	r := &txRecord{
+		Hash:       tx.TxHash(),
+		Tx:         buf.Bytes(),
+		Status:     txPending,
+		Sent:       now,
+		LastSent:   now,
+		SentHeight: height,
+	}
+	if err := saveTx(db, r); err != nil {
+		return err
+	}
+
+	err = cs.SendTransaction(tx)
+	if err == nil {
+		return nil
+	}
+	r.Status = txFailed
+	r.Reason = err.Error()
+	if err := saveTx(db, r); err != nil {
+		return err
+	}
+
+	if pushtx.IsBroadcastError(err, pushtx.Invalid) {
+		spent, err := spentInputs(tx.Mweb.TxBody)
+		if err != nil {
+			return err
+		}
+		if len(spent) > 0 {
+			s.startRecovery(spent)
+		}
+	}
+	return err
+}
+
+func coinExists(outputId *chainhash.Hash) (bool, error) {
+	_, err := cs.MwebCoinDB.FetchCoin(outputId)
+	if errors.Is(err, mwebdb.ErrCoinNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func spentInputs(txBody *wire.MwebTxBody) (spent []chainhash.Hash, err error) {
+	for _, input := range txBody.Inputs {
+		exists, err := coinExists(&input.OutputId)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			spent = append(spent, input.OutputId)
+		}
+	}
+	return
+}
+
+// kernelSearchDepth bounds how many blocks are searched for a tx's
+// kernel, which covers the time a tx is tracked for.
+const kernelSearchDepth = 600
+
+// checkTx works out the fate of a broadcast transaction from the MWEB
+// UTXO set. Any of our outputs appearing means it was mined, while some
+// of our inputs disappearing without them means a conflicting spend.
+// If all of the inputs are gone, our outputs may have been mined and
+// since spent, so the blocks since the tx was sent are searched for its
+// kernels to tell that apart from a double spend.
+func checkTx(tx *wire.MsgTx, sentHeight, height uint32) (
+	confirmed bool, spent []chainhash.Hash, err error) {
+
+	for _, output := range tx.Mweb.TxBody.Outputs {
+		if confirmed, err = coinExists(output.Hash()); confirmed || err != nil {
+			return
+		}
+	}
+	if spent, err = spentInputs(tx.Mweb.TxBody); err != nil {
+		return
+	}
+	if len(spent) == len(tx.Mweb.TxBody.Inputs) {
+		if height > kernelSearchDepth {
+			sentHeight = max(sentHeight, height-kernelSearchDepth)
+		}
+		if confirmed, err = findKernels(tx.Mweb.TxBody, sentHeight+1, height); confirmed {
+			spent = nil
+		}
+	}
+	return
+}
+
+// findKernels looks for the kernels of a tx in the blocks in the range.
+func findKernels(txBody *wire.MwebTxBody, from, to uint32) (bool, error) {
+	for height := from; height <= to; height++ {
+		hash, err := cs.GetBlockHash(int64(height))
+		if err != nil {
+			return false, err
+		}
+		block, err := cs.GetBlock(*hash)
+		if err != nil {
+			return false, err
+		}
+		if hasKernels(block.MsgBlock(), txBody) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func hasKernels(block *wire.MsgBlock, txBody *wire.MwebTxBody) bool {
+	if block.MwebTransactions == nil || len(txBody.Kernels) == 0 {
+		return false
+	}
+	for _, kernel := range txBody.Kernels {
+		if !slices.ContainsFunc(block.MwebTransactions.Kernels, func(k *wire.MwebKernel) bool {
+			return *k.Hash() == *kernel.Hash()
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *swapService) checkTxs(height uint32) error {
+	txs, err := loadTxs(db)
+	if err != nil {
+		return err
+	}
+	for _, r := range txs {
+		if r.Status != txPending {
+			continue
+		}
+		tx, err := r.msgTx()
+		if err != nil {
+			return err
+		}
+		confirmed, spent, err := checkTx(tx, r.SentHeight, height)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case confirmed:
+			fmt.Println("Transaction", r.Hash, "confirmed")
+			cs.MarkAsConfirmed(r.Hash)
+			r.Status = txConfirmed
+			r.Height = height
+			if err = deleteSpending(txInputs(tx.Mweb.TxBody)); err != nil {
+				return err
+			}
+		case len(spent) > 0:
+			fmt.Println("Transaction", r.Hash, "has", len(spent), "conflicting inputs")
+			cs.MarkAsConfirmed(r.Hash)
+			r.Status = txFailed
+			r.Reason = "conflicting spend"
+			s.startRecovery(spent)
+		case time.Since(r.Sent) > txExpiry:
+			cs.MarkAsConfirmed(r.Hash)
+			r.Status = txFailed
+			r.Reason = "expired"
+		case time.Since(r.LastSent) > rebroadcastInterval:
+			if err = cs.SendTransaction(tx); err != nil {
+				fmt.Println("Rebroadcast", r.Hash, "failed:", err)
+			}
+			r.LastSent = time.Now()
+		default:
+			continue
+		}
+
+		if err = saveTx(db, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reorgTxs puts transactions confirmed above height back to pending,
+// so that they are rebroadcast and checked again.
+func reorgTxs(height uint32) error {
+	txs, err := loadTxs(db)
+	if err != nil {
+		return err
+	}
+	for _, r := range txs {
+		if r.Status != txConfirmed || r.Height <= height {
+			continue
+		}
+		fmt.Println("Transaction", r.Hash, "unconfirmed by reorg")
+		r.Status = txPending
+		r.Height = 0
+		r.Sent = time.Now()
+		r.SentHeight = height
+		r.LastSent = time.Time{}
+		if err = saveTx(db, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchTxsForever restarts watchTxs whenever it fails, backing off
+// while it keeps failing.
+func (s *swapService) watchTxsForever() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		fmt.Println("watchTxs:", s.watchTxs())
+		if time.Since(start) > maxWatchBackoff {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxWatchBackoff)
+	}
+}
+
+func (s *swapService) watchTxs() error {
+	sub, err := (&neutrino.RescanChainSource{ChainService: cs}).Subscribe(0)
+	if err != nil {
+		return err
+	}
+	defer sub.Cancel()
+
+	_, height, err := cs.BlockHeaders.ChainTip()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ntfn, ok := <-sub.Notifications:
+			if !ok {
+				return errors.New("block subscription closed")
+			}
+			switch ntfn.(type) {
+			case *blockntfns.Connected:
+				height = ntfn.Height()
+			case *blockntfns.Disconnected:
+				lastReorg.Store(time.Now().Unix())
+				height = ntfn.Height() - 1
+				if err = reorgTxs(height); err != nil {
+					return err
+				}
+			default:
+				continue
+			}
+		case <-ticker.C:
+		}
+		// Coins missing from a coin DB that is behind would
+		// look like conflicting spends.
+		if !isSynced() {
+			continue
+		}
+		if err = s.checkTxs(height); err != nil {
+			return err
+		}
+	}
+}
+
+const maxRecoveries = 3
+
+func (s *swapService) startRecovery(spent []chainhash.Hash) {
+	go func() {
+		if err := s.recoverSwap(spent); err != nil {
+			fmt.Println("recoverSwap:", err)
+		}
+	}()
+}
+
+// recoverSwap reruns the round without the onions whose inputs were
+// spent elsewhere, so that the honest participants still get mixed.
+func (s *swapService) recoverSwap(spent []chainhash.Hash) error {
+	if err := s.dropSpent(spent); err != nil {
+		return err
+	}
+
+	fmt.Println("Starting recovery round without", len(spent), "inputs")
+	a := s.prepareRound()
+	if a == nil {
+		return nil
+	}
+
+	s.roundMu.Lock()
+	defer s.roundMu.Unlock()
+
+	return s.startRound(a)
+}
+
+func (s *swapService) dropSpent(spent []chainhash.Hash) error {
+	s.roundMu.Lock()
+	defer s.roundMu.Unlock()
+
+	if s.recoveries >= maxRecoveries {
+		return errors.New("too many recovery rounds")
+	}
+	s.recoveries++
+
+	return deleteSpending(spent)
+}
+
+func txInputs(txBody *wire.MwebTxBody) (outputIds []chainhash.Hash) {
+	for _, input := range txBody.Inputs {
+		outputIds = append(outputIds, input.OutputId)
+	}
+	return
+}
+
+// deleteSpending deletes the queued onions spending any of the coins.
+func deleteSpending(outputIds []chainhash.Hash) error {
+	onions, err := loadOnions(db)
+	if err != nil {
+		return err
+	}
+	for _, q := range onions {
+		if slices.ContainsFunc(outputIds, func(outputId chainhash.Hash) bool {
+			return bytes.Equal(q.Input.OutputId, outputId[:])
+		}) {
+			if err = deleteOnion(db, q.Onion); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *adminService) Transactions() ([]*txRecord, error) {
+	return loadTxs(db)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+func TestReorgTxs(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range []*txRecord{
+		{Hash: chainhash.Hash{1}, Status: txConfirmed, Height: 100},
+		{Hash: chainhash.Hash{2}, Status: txConfirmed, Height: 101},
+		{Hash: chainhash.Hash{3}, Status: txFailed},
+	} {
+		if err := saveTx(db, r); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	if err := reorgTxs(100); err != nil {
+		t.Fatal(err)
+	}
+	txs, err := loadTxs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[chainhash.Hash]string{
+		{1}: txConfirmed,
+		{2}: txPending,
+		{3}: txFailed,
+	}
+	for _, r := range txs {
+		if r.Status != want[r.Hash] {
+			t.Fatal(r.Hash, r.Status)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	if !isTransient(fmt.Errorf("round: %w", transientError{errors.New("coin missing")})) {
+		t.Fatal("wrapped transient error not detected")
+	}
+	if isTransient(errors.New("verify onion sig failed")) {
+		t.Fatal("permanent error detected as transient")
+	}
+}
+
+func TestHasKernels(t *testing.T) {
+	newKernel := func() *wire.MwebKernel {
+		fee := uint64(1000)
+		return mweb.CreateKernel((*mw.BlindingFactor)(randSecretKey()),
+			(*mw.BlindingFactor)(randSecretKey()), &fee, nil, nil, nil)
+	}
+	ours, other := newKernel(), newKernel()
+	txBody := &wire.MwebTxBody{Kernels: []*wire.MwebKernel{ours}}
+
+	if hasKernels(&wire.MsgBlock{}, txBody) {
+		t.Fatal("kernel found in block without MWEB")
+	}
+	block := &wire.MsgBlock{MwebTransactions: &wire.MwebTxBody{
+		Kernels: []*wire.MwebKernel{other}}}
+	if hasKernels(block, txBody) {
+		t.Fatal("kernel found in block without it")
+	}
+	block.MwebTransactions.Kernels = append(block.MwebTransactions.Kernels, ours)
+	if !hasKernels(block, txBody) {
+		t.Fatal("kernel not found")
+	}
+}
+
+func TestDeleteSpending(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	mixed := &queuedOnion{Onion: testSignedOnion(t), Submitted: time.Now()}
+	other := &queuedOnion{Onion: testSignedOnion(t), Submitted: time.Now()}
+	for _, q := range []*queuedOnion{mixed, other} {
+		if err := saveOnion(db, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	txBody := &wire.MwebTxBody{Inputs: []*wire.MwebInput{
+		{OutputId: chainhash.Hash(mixed.Input.OutputId)},
+		{OutputId: chainhash.Hash{1}},
+	}}
+	if err := deleteSpending(txInputs(txBody)); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := hasOnion(db, mixed.Input.Commitment); found {
+		t.Fatal("mixed onion still queued")
+	}
+	if found, _ := hasOnion(db, other.Input.Commitment); !found {
+		t.Fatal("other onion deleted")
+	}
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var errOffline = errors.New("offline")
+
+var (
+	// CacheDir, if set, is where the node list is kept once its
+	// signatures have been checked, along with the signers' keys, for
+	// when they can't be fetched.
+	CacheDir string
+
+	// Offline stops anything being fetched, so that the node list only
+	// comes from the cache and the override.
+	Offline bool
+)
+
+func readCache(name string) ([]byte, error) {
+	if CacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+	return os.ReadFile(filepath.Join(CacheDir, name))
+}
+
+// writeCache replaces a cached file, so that a crash can't leave it
+// half written.
+func writeCache(name string, data []byte) error {
+	if CacheDir == "" {
+		return nil
+	}
+	path := filepath.Join(CacheDir, name)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func cacheNodes(nodesTxt, nodesSig []byte) error {
+	if err := writeCache("nodes.sig.tar", nodesSig); err != nil {
+		return err
+	}
+	return writeCache("nodes.txt", nodesTxt)
+}
+
+func cachedNodes() (nodesTxt, nodesSig []byte, err error) {
+	if nodesTxt, err = readCache("nodes.txt"); err != nil {
+		return
+	}
+	nodesSig, err = readCache("nodes.sig.tar")
+	return
+}
+
+// nodeOverride is a line of the override file.
+type nodeOverride struct {
+	op   string
+	node Node
+}
+
+// overrides are applied to Nodes whenever the list is refreshed.
+var overrides []nodeOverride
+
+// LoadOverride reads the local override of the node list. Each line is
+// one of:
+//
+//	add <url> <pubkey> [<identity key>]
+//	remove <pubkey>
+//	pin <pubkey>
+//
+// An added node replaces any listed nodes with the same key. If any
+// nodes are pinned, only those are used. The nodes of a round must all
+// know each other, but otherwise their lists may differ.
+func LoadOverride(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var ovs []nodeOverride
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		ss := strings.Fields(s.Text())
+		if len(ss) == 0 || strings.HasPrefix(ss[0], "#") {
+			continue
+		}
+		ov := nodeOverride{op: ss[0]}
+		switch {
+		case ov.op == "add" && (len(ss) == 3 || len(ss) == 4):
+			ov.node = Node{Url: ss[1], pubKey: ss[2]}
+			if len(ss) == 4 {
+				if ov.node.idKey = ss[3]; ov.node.IdentityKey() == nil {
+					return fmt.Errorf("%s:%d: bad identity key", path, n)
+				}
+			}
+		case (ov.op == "remove" || ov.op == "pin") && len(ss) == 2:
+			ov.node = Node{pubKey: ss[1]}
+		default:
+			return fmt.Errorf("%s:%d: bad override", path, n)
+		}
+		if ov.node.PubKey() == nil {
+			return fmt.Errorf("%s:%d: bad public key", path, n)
+		}
+		ovs = append(ovs, ov)
+	}
+	if err = s.Err(); err != nil {
+		return err
+	}
+
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+
+	overrides = ovs
+	buildNodes()
+	return nil
+}
+
+// buildNodes applies the override to the listed nodes. Nodes is built
+// afresh each time, so that refreshing the list can't undo the override.
+// It must be called with nodesMu held.
+func buildNodes() {
+	Nodes = slices.Clone(listedNodes)
+	sameKey := func(node Node) func(Node) bool {
+		return func(n Node) bool { return n.PubKey().Equal(node.PubKey()) }
+	}
+	var pinned []Node
+	for _, ov := range overrides {
+		switch ov.op {
+		case "add":
+			if i := slices.IndexFunc(Nodes, sameKey(ov.node)); i >= 0 {
+				Nodes[i] = ov.node
+				Nodes = append(Nodes[:i+1], slices.DeleteFunc(Nodes[i+1:], sameKey(ov.node))...)
+			} else {
+				Nodes = append(Nodes, ov.node)
+			}
+		case "remove":
+			Nodes = slices.DeleteFunc(Nodes, sameKey(ov.node))
+		case "pin":
+			pinned = append(pinned, ov.node)
+		}
+	}
+	if len(pinned) > 0 {
+		Nodes = slices.DeleteFunc(Nodes, func(n Node) bool {
+			return slices.IndexFunc(pinned, sameKey(n)) < 0
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const pk2 = "a7eb3f598607a367f1e152f82f37ca7543a50b0e09d85bdae4d0476af8b2d32f"
+
+func TestOverride(t *testing.T) {
+	defer func(nodes []Node) {
+		listedNodes, overrides = nodes, nil
+		buildNodes()
+	}(slices.Clone(listedNodes))
+	listedNodes = []Node{{Url: "url1", pubKey: pk}, {Url: "url2", pubKey: pk2}}
+
+	path := filepath.Join(t.TempDir(), "nodes")
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# comment\nadd url3 " + pk + " " + idKey + "\n")
+	if err := LoadOverride(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(Nodes) != 2 || Nodes[0] != (Node{"url3", pk, idKey}) {
+		t.Fatal(Nodes)
+	}
+	parseNodes(bytes.NewReader([]byte("url1 " + pk + "\nurl4 " + pk)))
+	if len(Nodes) != 2 || Nodes[0] != (Node{"url3", pk, idKey}) {
+		t.Fatal("override undone by refresh", Nodes)
+	}
+
+	write("remove " + pk + "\n")
+	if err := LoadOverride(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(Nodes) != 1 || Nodes[0].pubKey != pk2 {
+		t.Fatal(Nodes)
+	}
+
+	write("add url1 " + pk + "\npin " + pk + "\n")
+	if err := LoadOverride(path); err != nil {
+		t.Fatal(err)
+	}
+	parseNodes(bytes.NewReader([]byte("url2 " + pk2)))
+	if len(Nodes) != 1 || Nodes[0].pubKey != pk {
+		t.Fatal(Nodes)
+	}
+
+	for _, s := range []string{"add url1", "remove pk", "pin " + pk + " url", "drop " + pk} {
+		write(s)
+		if LoadOverride(path) == nil {
+			t.Fatal("bad override accepted:", s)
+		}
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	defer func() { CacheDir, Offline = "", false }()
+	if _, _, err := cachedNodes(); err == nil {
+		t.Fatal("cache without directory")
+	}
+
+	CacheDir, Offline = t.TempDir(), true
+	if _, _, err := fetchSignedNodes(); err != errOffline {
+		t.Fatal("fetched while offline")
+	}
+	if err := cacheNodes([]byte("nodes"), []byte("sigs")); err != nil {
+		t.Fatal(err)
+	}
+	nodesTxt, nodesSig, err := cachedNodes()
+	if err != nil || string(nodesTxt) != "nodes" || string(nodesSig) != "sigs" {
+		t.Fatal("cache mismatch")
+	}
+}
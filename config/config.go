@@ -3,9 +3,11 @@ package config
 import (
 	"context"
 	"crypto/ecdh"
+	"crypto/ed25519"
 	"encoding/hex"
 	"fmt"
-	"net/http"
+	"slices"
+	"sync"
 	"time"
 )
 
@@ -15,25 +17,76 @@ func (node Node) PubKey() *ecdh.PublicKey {
 	return pubKey
 }
 
-func AliveNodes(ctx context.Context, pubKey *ecdh.PublicKey) (nodes []Node, index int) {
+// IdentityKey returns the node's Ed25519 key, which it signs with, or
+// nil if it hasn't published one.
+func (node Node) IdentityKey() ed25519.PublicKey {
+	bs, _ := hex.DecodeString(node.idKey)
+	if len(bs) != ed25519.PublicKeySize {
+		return nil
+	}
+	return bs
+}
+
+// AliveNodes returns the nodes that answer swap_info compatibly, in the
+// order they are listed, along with our own index among them. Nodes are
+// asked in parallel, each with a timeout.
+func AliveNodes(ctx context.Context, pubKey *ecdh.PublicKey, network string) (nodes []Node, index int) {
 	index = -1
-	fetchRemoteNodes()
-	for _, node := range Nodes {
+	refreshNodes()
+
+	nodesMu.RLock()
+	all := slices.Clone(Nodes)
+	nodesMu.RUnlock()
+
+	alive := make([]bool, len(all))
+	var wg sync.WaitGroup
+	for i, node := range all {
 		if pubKey != nil && node.PubKey().Equal(pubKey) {
-			index = len(nodes)
-			nodes = append(nodes, node)
+			alive[i] = true
 			continue
 		}
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, node.Url, nil)
-		fmt.Print("Checking node ", node.Url, "...")
-		if resp, err := http.DefaultClient.Do(req); err == nil && resp.StatusCode == http.StatusOK {
-			nodes = append(nodes, node)
-			fmt.Println(" ok")
-		} else {
-			fmt.Println(" not ok")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			if _, err := node.Info(ctx, network); err != nil {
+				fmt.Println("Checking node", node.Url, "... not ok:", err)
+				return
+			}
+			fmt.Println("Checking node", node.Url, "... ok")
+			alive[i] = true
+		}()
+	}
+	wg.Wait()
+
+	for i, node := range all {
+		if !alive[i] {
+			continue
 		}
-		cancel()
+		if pubKey != nil && node.PubKey().Equal(pubKey) {
+			index = len(nodes)
+		}
+		nodes = append(nodes, node)
 	}
 	return
 }
+
+// FindNode looks up a node of the list by its public key.
+func FindNode(pubKey *ecdh.PublicKey) (Node, bool) {
+	nodesMu.RLock()
+	defer nodesMu.RUnlock()
+
+	for _, node := range Nodes {
+		if node.PubKey().Equal(pubKey) {
+			return node, true
+		}
+	}
+	return Node{}, false
+}
+
+// NewNode returns a node with the given URL and hex encoded keys, the
+// identity key being optional.
+func NewNode(url, pubKey, idKey string) Node {
+	return Node{Url: url, pubKey: pubKey, idKey: idKey}
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ProtocolVersion is bumped whenever nodes of different versions
+// can no longer take part in the same round.
+const ProtocolVersion = 3
+
+// NodeInfo is the reply to swap_info.
+type NodeInfo struct {
+	ProtocolVersion int    `json:"protocol_version"`
+	Network         string `json:"network"`
+	PubKey          string `json:"pubkey"`
+	IdentityKey     string `json:"identity_key"`
+	Proof           string `json:"proof"`
+	Synced          bool   `json:"synced"`
+	TipHeight       uint32 `json:"tip_height"`
+	TipHash         string `json:"tip_hash"`
+	NodesHash       string `json:"nodes_hash"`
+}
+
+// NodesHash commits to the node list, regardless of the order in
+// which its entries were added.
+func NodesHash() string {
+	nodesMu.RLock()
+	defer nodesMu.RUnlock()
+
+	var lines []string
+	for _, node := range Nodes {
+		lines = append(lines, node.Url+" "+node.pubKey+" "+node.idKey+"\n")
+	}
+	slices.Sort(lines)
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// InfoProof proves possession of a node's key to the holder of the
+// other key, over the challenge they sent.
+func InfoProof(privKey *ecdh.PrivateKey, pubKey *ecdh.PublicKey, challenge []byte) ([]byte, error) {
+	secret, err := privKey.ECDH(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte("MWIXNET-INFO"))
+	h.Write(challenge)
+	return h.Sum(nil), nil
+}
+
+// Info asks a node for its swap_info, and checks that it is compatible
+// with ours and that it holds the key listed for it.
+func (node Node) Info(ctx context.Context, network string) (*NodeInfo, error) {
+	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	challenge := make([]byte, 32)
+	if _, err = rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	client, err := rpc.DialContext(ctx, node.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var info NodeInfo
+	err = client.CallContext(ctx, &info, "swap_info",
+		hex.EncodeToString(challenge),
+		hex.EncodeToString(privKey.PublicKey().Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	if err = node.checkInfo(&info, network, privKey, challenge); err != nil {
+		return nil, err
+	}
+	// Node lists may differ for a while as they are refreshed, and the
+	// node set of each round is agreed explicitly, so this is advisory.
+	if info.NodesHash != NodesHash() {
+		fmt.Println("Node", node.Url, "has a different node list")
+	}
+	return &info, nil
+}
+
+func (node Node) checkInfo(info *NodeInfo, network string,
+	privKey *ecdh.PrivateKey, challenge []byte) error {
+
+	switch {
+	case info.ProtocolVersion != ProtocolVersion:
+		return fmt.Errorf("protocol version %d", info.ProtocolVersion)
+	case info.Network != network:
+		return fmt.Errorf("network %s", info.Network)
+	case info.PubKey != node.pubKey:
+		return errors.New("public key mismatch")
+	case node.idKey != "" && info.IdentityKey != node.idKey:
+		return errors.New("identity key mismatch")
+	case !info.Synced:
+		return errors.New("not synced")
+	}
+
+	pubKey := node.PubKey()
+	if pubKey == nil {
+		return errors.New("bad public key")
+	}
+	proof, err := InfoProof(privKey, pubKey, challenge)
+	if err != nil {
+		return err
+	}
+	if theirs, _ := hex.DecodeString(info.Proof); !hmac.Equal(proof, theirs) {
+		return errors.New("bad proof of key possession")
+	}
+	return nil
+}
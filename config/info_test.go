@@ -0,0 +1,50 @@
+package config
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func TestCheckInfo(t *testing.T) {
+	serverKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	clientKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	node := Node{Url: "url", pubKey: hex.EncodeToString(serverKey.PublicKey().Bytes()), idKey: idKey}
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+
+	proof, err := InfoProof(serverKey, clientKey.PublicKey(), challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := func() *NodeInfo {
+		return &NodeInfo{
+			ProtocolVersion: ProtocolVersion,
+			Network:         "mainnet",
+			PubKey:          node.pubKey,
+			IdentityKey:     idKey,
+			Proof:           hex.EncodeToString(proof),
+			Synced:          true,
+			NodesHash:       NodesHash(),
+		}
+	}
+	if err = node.checkInfo(info(), "mainnet", clientKey, challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tamper := range []func(*NodeInfo){
+		func(i *NodeInfo) { i.ProtocolVersion++ },
+		func(i *NodeInfo) { i.Network = "testnet4" },
+		func(i *NodeInfo) { i.PubKey = pk },
+		func(i *NodeInfo) { i.IdentityKey = "" },
+		func(i *NodeInfo) { i.Synced = false },
+		func(i *NodeInfo) { i.Proof = hex.EncodeToString(challenge) },
+	} {
+		i := info()
+		tamper(i)
+		if node.checkInfo(i, "mainnet", clientKey, challenge) == nil {
+			t.Fatal("tampered info accepted")
+		}
+	}
+}
@@ -5,19 +5,27 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Node struct {
 	Url    string
 	pubKey string
+	idKey  string
 }
 
-var Nodes = []Node{
+// Nodes is the node list in use: the listed nodes with the local
+// override applied.
+var Nodes = slices.Clone(listedNodes)
+
+// listedNodes are the built-in nodes along with those of the signed list.
+var listedNodes = []Node{
 	{
 		Url:    "https://ltcmweb.xyz/coinswap",
 		pubKey: "0b5c751e877223c66246f154198abcd9215f6fa3649fcfadeb9025bedd99e319",
@@ -45,16 +53,43 @@ func fetchFile(name string) ([]byte, error) {
 	return io.ReadAll(resp.Body)
 }
 
-func fetchRemoteNodes() {
-	nodesTxt, err := fetchFile("config/nodes.txt")
-	if err != nil {
+// minSigs is how many of the signers must have signed the node list.
+const minSigs = 3
+
+func fetchSignedNodes() (nodesTxt, nodesSig []byte, err error) {
+	if Offline {
+		return nil, nil, errOffline
+	}
+	if nodesTxt, err = fetchFile("config/nodes.txt"); err != nil {
 		return
 	}
-	nodesSig, err := fetchFile("config/nodes.sig.tar")
-	if err != nil {
+	if nodesSig, err = fetchFile("config/nodes.sig.tar"); err != nil {
 		return
 	}
-	if checkSigCount(nodesTxt, bytes.NewReader(nodesSig)) >= 3 {
+	err = checkSigs(nodesTxt, nodesSig)
+	return
+}
+
+func checkSigs(nodesTxt, nodesSig []byte) error {
+	if checkSigCount(nodesTxt, bytes.NewReader(nodesSig)) < minSigs {
+		return errors.New("node list not signed")
+	}
+	return nil
+}
+
+// refreshNodes merges the signed node list into Nodes. The list is
+// fetched unless we are offline, falling back to the cached copy, and
+// the local override is applied on top of it.
+func refreshNodes() {
+	nodesTxt, nodesSig, err := fetchSignedNodes()
+	if err == nil {
+		if err := cacheNodes(nodesTxt, nodesSig); err != nil {
+			fmt.Println("Caching node list:", err)
+		}
+	} else if nodesTxt, nodesSig, err = cachedNodes(); err == nil {
+		err = checkSigs(nodesTxt, nodesSig)
+	}
+	if err == nil {
 		parseNodes(bytes.NewReader(nodesTxt))
 	}
 }
@@ -72,15 +107,37 @@ func checkSigCount(signed []byte, sigs io.Reader) int {
 	return len(signers)
 }
 
+// nodesMu guards Nodes against the remote list being merged into it
+// while it is being read.
+var nodesMu sync.RWMutex
+
 func parseNodes(r io.Reader) {
+	nodesMu.Lock()
+	defer nodesMu.Unlock()
+
 	for s := bufio.NewScanner(r); s.Scan(); {
 		ss := strings.Split(s.Text(), " ")
 		if len(ss) < 2 {
 			continue
 		}
-		node := Node{ss[0], ss[1]}
-		if !slices.Contains(Nodes, node) && node.PubKey() != nil {
-			Nodes = append(Nodes, node)
+		node := Node{Url: ss[0], pubKey: ss[1]}
+		if node.PubKey() == nil {
+			continue
+		}
+		if len(ss) > 2 {
+			if node.idKey = ss[2]; node.IdentityKey() == nil {
+				continue
+			}
+		}
+		i := slices.IndexFunc(listedNodes, func(n Node) bool {
+			return n.Url == node.Url && n.pubKey == node.pubKey
+		})
+		switch {
+		case i < 0:
+			listedNodes = append(listedNodes, node)
+		case listedNodes[i].idKey == "":
+			listedNodes[i].idKey = node.idKey
 		}
 	}
+	buildNodes()
 }
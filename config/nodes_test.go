@@ -6,16 +6,24 @@ import (
 	"testing"
 )
 
-const pk = "0b5c751e877223c66246f154198abcd9215f6fa3649fcfadeb9025bedd99e319"
+const (
+	pk    = "0b5c751e877223c66246f154198abcd9215f6fa3649fcfadeb9025bedd99e319"
+	idKey = "3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c"
+)
 
 func TestNodes(t *testing.T) {
 	n := len(Nodes)
 	for i := 0; i < 2; i++ {
 		parseNodes(strings.NewReader("url1 " + pk + "\nurl2 pk"))
-		if len(Nodes) != n+1 || Nodes[n] != (Node{"url1", pk}) {
+		if len(Nodes) != n+1 || Nodes[n] != (Node{Url: "url1", pubKey: pk}) {
 			t.Fatal()
 		}
 	}
+
+	parseNodes(strings.NewReader("url1 " + pk + " " + idKey + "\nurl3 " + pk + " id"))
+	if len(Nodes) != n+1 || Nodes[n].IdentityKey() == nil {
+		t.Fatal()
+	}
 }
 
 func TestSigs(t *testing.T) {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -27,14 +28,14 @@ func fetchPgpKey(signer string) (openpgp.KeyRing, error) {
 	if signerKeys[signer] != nil {
 		return signerKeys[signer], nil
 	}
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get("https://raw.githubusercontent.com/DavidBurkett" +
-		"/ltc-release-builder/master/gitian-keys/" + signer + "-key.pgp")
+	name := signer + "-key.pgp"
+	data, err := readCache(name)
 	if err != nil {
-		return nil, err
+		if data, err = fetchPgpKeyFile(name); err != nil {
+			return nil, err
+		}
 	}
-	defer resp.Body.Close()
-	key, err := openpgp.ReadArmoredKeyRing(resp.Body)
+	key, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
@@ -42,9 +43,26 @@ func fetchPgpKey(signer string) (openpgp.KeyRing, error) {
 		return nil, errors.New("wrong fingerprint")
 	}
 	signerKeys[signer] = key
+	if err = writeCache(name, data); err != nil {
+		fmt.Println("Caching", name+":", err)
+	}
 	return key, nil
 }
 
+func fetchPgpKeyFile(name string) ([]byte, error) {
+	if Offline {
+		return nil, errOffline
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("https://raw.githubusercontent.com/DavidBurkett" +
+		"/ltc-release-builder/master/gitian-keys/" + name)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
 func verifyPgpSig(signed, signature io.Reader) (string, bool) {
 	sig, err := io.ReadAll(signature)
 	if err != nil {
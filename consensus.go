@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ltcmweb/coinswapd/config"
+)
+
+// Each node works out the alive nodes for itself, so two nodes can
+// disagree on who takes part in a round and at which position. Before a
+// round, the entry node proposes the ordered node set along with a round
+// id, and the round only runs once every node in the set has acked it.
+// The other nodes then take their position from the proposal rather
+// than from their own view.
+
+const (
+	proposalTimeout = 10 * time.Second
+	agreementTTL    = 10 * time.Minute
+
+	// maxProposals bounds how many times the entry node proposes a
+	// smaller set, leaving out the nodes that didn't ack the last one.
+	maxProposals = 3
+
+	proposeTag = "MWIXNET-PROPOSE"
+	ackTag     = "MWIXNET-ACK"
+)
+
+// roundProposal is sent with swap_propose. Nodes lists the X25519 keys
+// (hex) of the nodes in round order, the first being the proposer. Time
+// is when it was proposed, in Unix seconds.
+type roundProposal struct {
+	Id    []byte   `json:"id"`
+	Time  int64    `json:"time"`
+	Nodes []string `json:"nodes"`
+	Mac   []byte   `json:"mac"`
+	Sig   []byte   `json:"sig,omitempty"`
+}
+
+// roundAck is the reply to swap_propose.
+type roundAck struct {
+	Mac []byte `json:"mac"`
+	Sig []byte `json:"sig"`
+}
+
+// agreedRound is the node set and position that a round runs with.
+type agreedRound struct {
+	id        []byte
+	nodes     []config.Node
+	nodeIndex int
+	proposed  time.Time
+	expiry    time.Time
+}
+
+// signed returns what a proposal or an ack of it authenticates. The tag
+// tells them apart.
+func (p *roundProposal) signed(tag string) []byte {
+	msg := append([]byte(tag), p.Id...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(p.Time))
+	for _, node := range p.Nodes {
+		msg = append(msg, node+"\n"...)
+	}
+	return msg
+}
+
+// mac authenticates the proposal between us and the holder of pubKey.
+func (p *roundProposal) mac(pubKey *ecdh.PublicKey, tag string) ([]byte, error) {
+	if pubKey == nil {
+		return nil, errors.New("bad public key")
+	}
+	return roundMac(pubKey, p.signed(tag))
+}
+
+// sign signs the proposal with our identity key, so that anyone can
+// check which nodes took part in the round.
+func (p *roundProposal) sign(tag string) []byte {
+	return ed25519.Sign(identityKey, p.signed(tag))
+}
+
+// check verifies a proposal or ack from the given node. Nodes that
+// haven't published an identity key yet are authenticated by the mac
+// alone.
+func (p *roundProposal) check(tag string, node config.Node, mac, sig []byte) error {
+	expected, err := p.mac(node.PubKey(), tag)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, expected) {
+		return errors.New("bad mac")
+	}
+	if idKey := node.IdentityKey(); idKey != nil && !ed25519.Verify(idKey, p.signed(tag), sig) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// resolve maps the proposed keys to nodes of our own list.
+func (p *roundProposal) resolve() (nodes []config.Node, err error) {
+	for _, s := range p.Nodes {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		pubKey, err := ecdh.X25519().NewPublicKey(b)
+		if err != nil {
+			return nil, err
+		}
+		node, ok := config.FindNode(pubKey)
+		if !ok {
+			return nil, fmt.Errorf("unknown node %s", s)
+		}
+		if slices.Contains(nodes, node) {
+			return nil, fmt.Errorf("duplicate node %s", s)
+		}
+		nodes = append(nodes, node)
+	}
+	return
+}
+
+func newProposal(nodes []config.Node) (*roundProposal, error) {
+	p := &roundProposal{Id: make([]byte, 32), Time: time.Now().Unix()}
+	if _, err := rand.Read(p.Id); err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		p.Nodes = append(p.Nodes, hex.EncodeToString(node.PubKey().Bytes()))
+	}
+	return p, nil
+}
+
+// agreeRound proposes the node set, which must start with us, until all
+// of its nodes ack. A round needs at least two nodes.
+func agreeRound(nodes []config.Node) (*agreedRound, error) {
+	for i := 0; i < maxProposals; i++ {
+		if len(nodes) < 2 {
+			return nil, errors.New("too few nodes for a round")
+		}
+		p, err := newProposal(nodes)
+		if err != nil {
+			return nil, err
+		}
+		acked := propose(p, nodes[1:])
+		if !slices.Contains(acked, false) {
+			return &agreedRound{id: p.Id, nodes: nodes}, nil
+		}
+		remaining := slices.Clone(nodes[:1])
+		for j, ok := range acked {
+			if ok {
+				remaining = append(remaining, nodes[j+1])
+			}
+		}
+		nodes = remaining
+	}
+	return nil, errors.New("no agreement on the node set")
+}
+
+// propose sends the proposal to each of the nodes in parallel and
+// reports which of them acked it.
+func propose(p *roundProposal, nodes []config.Node) []bool {
+	acked := make([]bool, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := proposeTo(p, node); err != nil {
+				fmt.Println("swap_propose:", node.Url, err)
+				return
+			}
+			acked[i] = true
+		}()
+	}
+	wg.Wait()
+	return acked
+}
+
+func proposeTo(p *roundProposal, node config.Node) error {
+	p2 := *p
+	var err error
+	if p2.Mac, err = p.mac(node.PubKey(), proposeTag); err != nil {
+		return err
+	}
+	p2.Sig = p.sign(proposeTag)
+
+	ctx, cancel := context.WithTimeout(context.Background(), proposalTimeout)
+	defer cancel()
+	client, err := rpc.DialContext(ctx, node.Url)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var ack roundAck
+	if err = client.CallContext(ctx, &ack, "swap_propose", &p2); err != nil {
+		return err
+	}
+	if err = p.check(ackTag, node, ack.Mac, ack.Sig); err != nil {
+		return fmt.Errorf("ack: %w", err)
+	}
+	return nil
+}
+
+// Propose acks the entry node's proposal for the next round, which must
+// include us. The ack binds us to the proposed set, replacing any
+// earlier proposal that hasn't been used yet.
+func (s *swapService) Propose(p *roundProposal) (*roundAck, error) {
+	if len(p.Id) != 32 {
+		return nil, errors.New("round id must be 32 bytes")
+	}
+	nodes, err := p.resolve()
+	if err != nil {
+		return nil, err
+	}
+	index := slices.IndexFunc(nodes, func(node config.Node) bool {
+		return node.PubKey().Equal(serverKey.PublicKey())
+	})
+	if index <= 0 {
+		return nil, errors.New("not a participant")
+	}
+	if err = p.check(proposeTag, nodes[0], p.Mac, p.Sig); err != nil {
+		return nil, fmt.Errorf("proposal: %w", err)
+	}
+	if err = s.agree(p, nodes, index); err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Agreed to round", hex.EncodeToString(p.Id), "as node",
+		index+1, "of", len(nodes))
+	ack := &roundAck{Sig: p.sign(ackTag)}
+	if ack.Mac, err = p.mac(nodes[0].PubKey(), ackTag); err != nil {
+		return nil, err
+	}
+	return ack, nil
+}
+
+// agree makes the proposal the round we agreed to. Each proposal can
+// only be agreed to once, and not after a newer one, so that replaying
+// an earlier proposal can't supersede the round the entry node is
+// running. Proposal ids are remembered for as long as they are fresh.
+func (s *swapService) agree(p *roundProposal, nodes []config.Node, index int) error {
+	proposed := time.Unix(p.Time, 0)
+	if time.Since(proposed).Abs() > agreementTTL {
+		return errors.New("proposal expired")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, expiry := range s.proposals {
+		if now.After(expiry) {
+			delete(s.proposals, id)
+		}
+	}
+	if _, ok := s.proposals[string(p.Id)]; ok {
+		return errors.New("proposal already seen")
+	}
+	if s.agreed != nil && proposed.Before(s.agreed.proposed) {
+		return errors.New("proposal older than the current agreement")
+	}
+	if s.proposals == nil {
+		s.proposals = map[string]time.Time{}
+	}
+	s.proposals[string(p.Id)] = proposed.Add(agreementTTL)
+	s.agreed = &agreedRound{
+		id:        p.Id,
+		nodes:     nodes,
+		nodeIndex: index,
+		proposed:  proposed,
+		expiry:    now.Add(agreementTTL),
+	}
+	return nil
+}
+
+// agreedFor returns the round we last agreed to, if it has the given id
+// and hasn't expired.
+func (s *swapService) agreedFor(id []byte) *agreedRound {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.agreed
+	if a == nil || !bytes.Equal(a.id, id) || time.Now().After(a.expiry) {
+		return nil
+	}
+	return a
+}
+
+// useAgreed marks the agreed round as started, so that it can only be
+// started once. It fails if another proposal has replaced it meanwhile.
+func (s *swapService) useAgreed(a *agreedRound) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.agreed != a {
+		return false
+	}
+	s.agreed = nil
+	return true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/coinswapd/config"
+)
+
+func TestProposalMac(t *testing.T) {
+	defer func(key *ecdh.PrivateKey) { serverKey = key }(serverKey)
+	entryKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	nodeKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	p := &roundProposal{Id: make([]byte, 32), Nodes: []string{
+		hex.EncodeToString(entryKey.PublicKey().Bytes()),
+		hex.EncodeToString(nodeKey.PublicKey().Bytes()),
+	}}
+	rand.Read(p.Id)
+
+	serverKey = entryKey
+	sent, _ := p.mac(nodeKey.PublicKey(), "MWIXNET-PROPOSE")
+	ack, _ := p.mac(nodeKey.PublicKey(), "MWIXNET-ACK")
+	if hmac.Equal(sent, ack) {
+		t.Fatal("proposal and ack macs are equal")
+	}
+
+	serverKey = nodeKey
+	if mac, _ := p.mac(entryKey.PublicKey(), "MWIXNET-PROPOSE"); !hmac.Equal(mac, sent) {
+		t.Fatal("proposal mac mismatch")
+	}
+	if mac, _ := p.mac(entryKey.PublicKey(), "MWIXNET-ACK"); !hmac.Equal(mac, ack) {
+		t.Fatal("ack mac mismatch")
+	}
+
+	p.Nodes = p.Nodes[1:]
+	if mac, _ := p.mac(entryKey.PublicKey(), "MWIXNET-PROPOSE"); hmac.Equal(mac, sent) {
+		t.Fatal("mac doesn't cover the node set")
+	}
+	if _, err := p.resolve(); err == nil {
+		t.Fatal("unknown node resolved")
+	}
+	if _, err := (&swapService{}).Propose(p); err == nil {
+		t.Fatal("proposal with unknown node acked")
+	}
+}
+
+func TestProposalSig(t *testing.T) {
+	defer func(key *ecdh.PrivateKey, idKey ed25519.PrivateKey) {
+		serverKey, identityKey = key, idKey
+	}(serverKey, identityKey)
+	entryKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	nodeKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	entryIdKey, entryIdPriv, _ := ed25519.GenerateKey(rand.Reader)
+	entry := config.NewNode("url", hex.EncodeToString(entryKey.PublicKey().Bytes()),
+		hex.EncodeToString(entryIdKey))
+
+	p := &roundProposal{Id: make([]byte, 32), Nodes: []string{
+		hex.EncodeToString(entryKey.PublicKey().Bytes()),
+		hex.EncodeToString(nodeKey.PublicKey().Bytes()),
+	}}
+	serverKey, identityKey = entryKey, entryIdPriv
+	mac, _ := p.mac(nodeKey.PublicKey(), proposeTag)
+	sig := p.sign(proposeTag)
+
+	serverKey = nodeKey
+	if err := p.check(proposeTag, entry, mac, sig); err != nil {
+		t.Fatal(err)
+	}
+	if p.check(ackTag, entry, mac, sig) == nil {
+		t.Fatal("proposal accepted as an ack")
+	}
+	if p.check(proposeTag, entry, mac, nil) == nil {
+		t.Fatal("unsigned proposal accepted")
+	}
+	_, identityKey, _ = ed25519.GenerateKey(rand.Reader)
+	if p.check(proposeTag, entry, mac, p.sign(proposeTag)) == nil {
+		t.Fatal("proposal signed with another key accepted")
+	}
+}
+
+func TestAgreeRoundTooFewNodes(t *testing.T) {
+	if _, err := agreeRound(config.Nodes[:1]); err == nil {
+		t.Fatal("round agreed with a single node")
+	}
+}
+
+func TestAgreedRound(t *testing.T) {
+	a := &agreedRound{id: []byte{1}, expiry: time.Now().Add(time.Minute)}
+	s := &swapService{agreed: a}
+	if s.agreedFor([]byte{2}) != nil {
+		t.Fatal("agreed round returned for another id")
+	}
+	if s.agreedFor(a.id) != a || !s.useAgreed(a) {
+		t.Fatal("agreed round not returned")
+	}
+	if s.agreedFor(a.id) != nil || s.useAgreed(a) {
+		t.Fatal("agreed round used twice")
+	}
+	s.agreed = &agreedRound{id: a.id, expiry: time.Now().Add(-time.Minute)}
+	if s.agreedFor(a.id) != nil {
+		t.Fatal("expired agreed round returned")
+	}
+	if s.useAgreed(a) {
+		t.Fatal("superseded round used")
+	}
+}
+
+func TestAgreeReplay(t *testing.T) {
+	s := &swapService{}
+	proposal := func(proposed time.Time) *roundProposal {
+		p := &roundProposal{Id: make([]byte, 32), Time: proposed.Unix()}
+		rand.Read(p.Id)
+		return p
+	}
+	old, current := proposal(time.Now().Add(-time.Minute)), proposal(time.Now())
+
+	if err := s.agree(old, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.agree(current, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if s.agree(current, nil, 1) == nil {
+		t.Fatal("replayed proposal agreed")
+	}
+	if s.agree(proposal(time.Now().Add(-time.Minute)), nil, 1) == nil {
+		t.Fatal("proposal older than the current one agreed")
+	}
+	if s.agreedFor(current.Id) == nil {
+		t.Fatal("current agreement superseded")
+	}
+	if s.agree(proposal(time.Now().Add(-agreementTTL-time.Minute)), nil, 1) == nil {
+		t.Fatal("expired proposal agreed")
+	}
+}
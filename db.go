@@ -2,50 +2,240 @@ package main
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"time"
 
 	"github.com/ltcmweb/coinswapd/onion"
 	"github.com/ltcsuite/ltcwallet/walletdb"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
-var coinswapOnionsBucket = []byte("coinswap-onions")
+// Everything we store lives under the coinswap bucket, next to the
+// schema version, so that it stays clear of neutrino's own buckets.
+var (
+	coinswapBucket = []byte("coinswap")
+	versionKey     = []byte("version")
+	onionsBucket   = []byte("onions")
+	txsBucket      = []byte("txs")
 
-func saveOnion(db walletdb.DB, onion *onion.Onion) error {
+	// onionCountKey holds the number of queued onions, so that the
+	// queue limit can be checked without scanning the queue.
+	onionCountKey = []byte("onion-count")
+
+	// quarantineBucket holds onions that a migration couldn't convert.
+	quarantineBucket = []byte("quarantine")
+)
+
+func readBucket(tx walletdb.ReadTx, name []byte) walletdb.ReadBucket {
+	return tx.ReadBucket(coinswapBucket).NestedReadBucket(name)
+}
+
+func writeBucket(tx walletdb.ReadWriteTx, name []byte) walletdb.ReadWriteBucket {
+	return tx.ReadWriteBucket(coinswapBucket).NestedReadWriteBucket(name)
+}
+
+// queuedOnion is an onion waiting at the entry node for a round.
+type queuedOnion struct {
+	*onion.Onion
+	Submitted time.Time
+	Expiry    time.Time
+}
+
+// expired reports whether the onion must no longer be mixed at time t,
+// having outlived either the TTL or the expiry set by its submitter.
+func (q *queuedOnion) expired(t time.Time) bool {
+	return t.After(q.Submitted.Add(*onionTTL)) ||
+		!q.Expiry.IsZero() && t.After(q.Expiry)
+}
+
+func unixTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Unix())
+}
+
+func fromUnixTime(u uint64) time.Time {
+	if u == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(u), 0)
+}
+
+// onionsAEAD seals queued onions at rest, as they link inputs to the
+// rounds they will take part in. The key is derived from the server key,
+// since an onion is of no use to a node that has lost that key anyway.
+func onionsAEAD() (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, []byte("MWIXNET-DB"))
+	h.Write(serverKey.Bytes())
+	return chacha20poly1305.NewX(h.Sum(nil))
+}
+
+// sealValue encrypts a value, binding it to its key in the bucket.
+func sealValue(k, v []byte) ([]byte, error) {
+	aead, err := onionsAEAD()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(v)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, v, k), nil
+}
+
+func openValue(k, v []byte) ([]byte, error) {
+	aead, err := onionsAEAD()
+	if err != nil {
+		return nil, err
+	}
+	if len(v) < aead.NonceSize() {
+		return nil, errSealedWithOtherKey
+	}
+	v, err = aead.Open(nil, v[:aead.NonceSize()], v[aead.NonceSize():], k)
+	if err != nil {
+		return nil, errSealedWithOtherKey
+	}
+	return v, nil
+}
+
+var errSealedWithOtherKey = errors.New("onion sealed with another server key")
+
+func saveOnion(db walletdb.DB, q *queuedOnion) error {
 	return walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
-		bucket, err := tx.CreateTopLevelBucket(coinswapOnionsBucket)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, unixTime(q.Submitted))
+		binary.Write(&buf, binary.BigEndian, unixTime(q.Expiry))
+		if err := q.Serialize(&buf); err != nil {
+			return err
+		}
+		v, err := sealValue(q.Input.Commitment, buf.Bytes())
 		if err != nil {
 			return err
 		}
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		enc.Encode(onion)
-		return bucket.Put(onion.Input.Commitment, buf.Bytes())
+		bucket := writeBucket(tx, onionsBucket)
+		if bucket.Get(q.Input.Commitment) == nil {
+			if err = addOnionCount(tx, 1); err != nil {
+				return err
+			}
+		}
+		return bucket.Put(q.Input.Commitment, v)
 	})
 }
 
-func loadOnions(db walletdb.DB) (onions []*onion.Onion, err error) {
+// loadOnions skips onions sealed with another server key, such as when
+// the node was restarted with a different -k. pruneOnions reports them.
+func loadOnions(db walletdb.DB) (onions []*queuedOnion, err error) {
 	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
-		bucket := tx.ReadBucket(coinswapOnionsBucket)
-		if bucket == nil {
+		return readBucket(tx, onionsBucket).ForEach(func(k, v []byte) error {
+			v, err := openValue(k, v)
+			if err == errSealedWithOtherKey {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			var (
+				r                 = bytes.NewReader(v)
+				submitted, expiry uint64
+				q                 = &queuedOnion{Onion: &onion.Onion{}}
+			)
+			binary.Read(r, binary.BigEndian, &submitted)
+			binary.Read(r, binary.BigEndian, &expiry)
+			if err := q.Deserialize(r); err != nil {
+				return err
+			}
+			q.Submitted, q.Expiry = fromUnixTime(submitted), fromUnixTime(expiry)
+			onions = append(onions, q)
 			return nil
-		}
-		return bucket.ForEach(func(k, v []byte) error {
-			var onion *onion.Onion
-			dec := gob.NewDecoder(bytes.NewReader(v))
-			err = dec.Decode(&onion)
-			onions = append(onions, onion)
-			return err
 		})
 	})
 	return
 }
 
+// countSealedWithOtherKey counts the onions that loadOnions skips.
+// They are kept, so that restarting with the right key recovers them.
+func countSealedWithOtherKey(db walletdb.DB) (n int, err error) {
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		return readBucket(tx, onionsBucket).ForEach(func(k, v []byte) error {
+			if _, err := openValue(k, v); err == errSealedWithOtherKey {
+				n++
+			}
+			return nil
+		})
+	})
+	return
+}
+
+func hasOnion(db walletdb.DB, commit []byte) (found bool, err error) {
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		found = readBucket(tx, onionsBucket).Get(commit) != nil
+		return nil
+	})
+	return
+}
+
 func deleteOnion(db walletdb.DB, onion *onion.Onion) error {
 	return walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
-		bucket := tx.ReadWriteBucket(coinswapOnionsBucket)
-		if bucket == nil {
+		bucket := writeBucket(tx, onionsBucket)
+		if bucket.Get(onion.Input.Commitment) == nil {
 			return nil
 		}
+		if err := addOnionCount(tx, -1); err != nil {
+			return err
+		}
 		return bucket.Delete(onion.Input.Commitment)
 	})
 }
+
+func countOnions(db walletdb.DB) (n int, err error) {
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		v := tx.ReadBucket(coinswapBucket).Get(onionCountKey)
+		if len(v) == 8 {
+			n = int(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return
+}
+
+func putOnionCount(tx walletdb.ReadWriteTx, n int) error {
+	return tx.ReadWriteBucket(coinswapBucket).Put(onionCountKey,
+		binary.BigEndian.AppendUint64(nil, uint64(max(n, 0))))
+}
+
+func addOnionCount(tx walletdb.ReadWriteTx, delta int) error {
+	v := tx.ReadWriteBucket(coinswapBucket).Get(onionCountKey)
+	n := 0
+	if len(v) == 8 {
+		n = int(binary.BigEndian.Uint64(v))
+	}
+	return putOnionCount(tx, n+delta)
+}
+
+func saveTx(db walletdb.DB, r *txRecord) error {
+	return walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		enc.Encode(r)
+		return writeBucket(tx, txsBucket).Put(r.Hash[:], buf.Bytes())
+	})
+}
+
+func loadTxs(db walletdb.DB) (txs []*txRecord, err error) {
+	err = walletdb.View(db, func(tx walletdb.ReadTx) error {
+		return readBucket(tx, txsBucket).ForEach(func(k, v []byte) error {
+			var r *txRecord
+			dec := gob.NewDecoder(bytes.NewReader(v))
+			err = dec.Decode(&r)
+			txs = append(txs, r)
+			return err
+		})
+	})
+	return
+}
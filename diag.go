@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type roundDiag struct {
+	Started   time.Time `json:"started"`
+	Round     string    `json:"round"`
+	Nodes     int       `json:"nodes"`
+	Onions    int       `json:"onions"`
+	Dropped   int       `json:"dropped"`
+	Expired   int       `json:"expired"`
+	Refused   int       `json:"refused"`
+	Transient int       `json:"transient"`
+	Deferred  int       `json:"deferred"`
+	BadMacs   int       `json:"bad_macs"`
+	Panics    int       `json:"panics"`
+	Inputs    int       `json:"inputs"`
+	Outputs   int       `json:"outputs"`
+	Kernels   int       `json:"kernels"`
+	Weight    uint64    `json:"weight"`
+	Errors    []string  `json:"errors"`
+}
+
+func (d *roundDiag) fail(stage string, err error) error {
+	err = fmt.Errorf("%s: %w", stage, err)
+	d.Errors = append(d.Errors, err.Error())
+	return err
+}
+
+func (s *swapService) diagnostics() roundDiag {
+	s.roundMu.Lock()
+	defer s.roundMu.Unlock()
+
+	if s.round == nil {
+		return roundDiag{}
+	}
+	return s.round.diag
+}
+
+// adminService serves the admin_ RPCs. They tell how rounds went and
+// which txs are ours, so they are only served on the loopback interface.
+type adminService struct {
+	s *swapService
+}
+
+func (a *adminService) Diagnostics() roundDiag {
+	return a.s.diagnostics()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+
+	"github.com/ltcmweb/coinswapd/config"
+)
+
+// identityKey signs what this node sends to other nodes. Its public key
+// is published in nodes.txt next to the X25519 key.
+var identityKey ed25519.PrivateKey
+
+// Tags of the messages passed between neighbours during a round.
+const (
+	forwardTag  = "MWIXNET-FORWARD"
+	backwardTag = "MWIXNET-BACKWARD"
+)
+
+// roundMessage carries a sealed payload of a round's forward or backward
+// pass. It is bound to the round, the phase and the recipient, and is
+// authenticated with the X25519 keys of both nodes and, if the sender
+// has published one, signed with its identity key.
+type roundMessage struct {
+	Round []byte `json:"round"`
+	Data  []byte `json:"data"`
+	Mac   []byte `json:"mac"`
+	Sig   []byte `json:"sig,omitempty"`
+}
+
+// signed returns what the message authenticates when sent to the node
+// with the given key. Round ids are always 32 bytes.
+func (m *roundMessage) signed(tag string, pubKey *ecdh.PublicKey) []byte {
+	msg := append([]byte(tag), pubKey.Bytes()...)
+	msg = append(msg, m.Round...)
+	return append(msg, m.Data...)
+}
+
+func roundMac(pubKey *ecdh.PublicKey, msg []byte) ([]byte, error) {
+	secret, err := serverKey.ECDH(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, secret)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func newRoundMessage(tag string, node config.Node, round, data []byte) (*roundMessage, error) {
+	m := &roundMessage{Round: round, Data: data}
+	msg := m.signed(tag, node.PubKey())
+	var err error
+	if m.Mac, err = roundMac(node.PubKey(), msg); err != nil {
+		return nil, err
+	}
+	m.Sig = ed25519.Sign(identityKey, msg)
+	return m, nil
+}
+
+// check verifies that the message was sent to us by the given node.
+// Nodes that haven't published an identity key yet are authenticated by
+// the mac alone.
+func (m *roundMessage) check(tag string, node config.Node) error {
+	msg := m.signed(tag, serverKey.PublicKey())
+	mac, err := roundMac(node.PubKey(), msg)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(m.Mac, mac) {
+		return errors.New("message not from the expected node")
+	}
+	if idKey := node.IdentityKey(); idKey != nil && !ed25519.Verify(idKey, msg, m.Sig) {
+		return errors.New("message not signed by the expected node")
+	}
+	return nil
+}
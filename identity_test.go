@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"testing"
+)
+
+func TestRoundMessageMac(t *testing.T) {
+	defer func(key *ecdh.PrivateKey) { serverKey = key }(serverKey)
+	senderKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	recipientKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	m := &roundMessage{Round: make([]byte, 32), Data: []byte("data")}
+	serverKey = senderKey
+	mac, _ := roundMac(recipientKey.PublicKey(), m.signed(forwardTag, recipientKey.PublicKey()))
+
+	serverKey = recipientKey
+	if mac2, _ := roundMac(senderKey.PublicKey(), m.signed(forwardTag, recipientKey.PublicKey())); !hmac.Equal(mac, mac2) {
+		t.Fatal("mac mismatch")
+	}
+	for _, msg := range [][]byte{
+		m.signed(backwardTag, recipientKey.PublicKey()),
+		m.signed(forwardTag, senderKey.PublicKey()),
+		(&roundMessage{Round: bytes.Repeat([]byte{1}, 32), Data: m.Data}).signed(forwardTag, recipientKey.PublicKey()),
+	} {
+		if mac2, _ := roundMac(senderKey.PublicKey(), msg); hmac.Equal(mac, mac2) {
+			t.Fatal("mac doesn't bind phase, recipient and round")
+		}
+	}
+}
+
+func TestUnexpectedMessages(t *testing.T) {
+	r := &round{id: []byte{1}, phase: phaseDone}
+	s := &swapService{round: r}
+	if err := s.Backward(&roundMessage{Round: []byte{2}}); err == nil {
+		t.Fatal("backward for another round accepted")
+	}
+	if err := s.Backward(&roundMessage{Round: r.id}); err == nil {
+		t.Fatal("backward replay accepted")
+	}
+	if err := s.Forward(&roundMessage{Round: r.id}); err == nil {
+		t.Fatal("forward replay accepted")
+	}
+	if err := s.Forward(&roundMessage{Round: []byte{2}}); err == nil {
+		t.Fatal("forward without agreement accepted")
+	}
+	if s.round != r {
+		t.Fatal("round was reset")
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+
+	"github.com/ltcmweb/coinswapd/config"
+	"github.com/ltcmweb/ltcd/chaincfg"
+)
+
+var network = chaincfg.MainNetParams.Name
+
+// Info lets other nodes check that we are compatible with them and that
+// we hold our key, by proving it over their challenge with the key they
+// sent (both hex encoded).
+func (s *swapService) Info(challenge, pubKey string) (*config.NodeInfo, error) {
+	challengeBytes, err := hex.DecodeString(challenge)
+	if err != nil || len(challengeBytes) != 32 {
+		return nil, errors.New("challenge must be 32 bytes")
+	}
+	pubKeyBytes, err := hex.DecodeString(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	peerKey, err := ecdh.X25519().NewPublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	proof, err := config.InfoProof(serverKey, peerKey, challengeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := cachedSyncState()
+	if err != nil {
+		return nil, err
+	}
+	tipHash, tipHeight, err := cs.BlockHeaders.ChainTip()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config.NodeInfo{
+		ProtocolVersion: config.ProtocolVersion,
+		Network:         network,
+		PubKey:          hex.EncodeToString(serverKey.PublicKey().Bytes()),
+		IdentityKey:     hex.EncodeToString(identityKey.Public().(ed25519.PublicKey)),
+		Proof:           hex.EncodeToString(proof),
+		Synced:          st.Synced,
+		TipHeight:       tipHeight,
+		TipHash:         tipHash.BlockHash().String(),
+		NodesHash:       config.NodesHash(),
+	}, nil
+}
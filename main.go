@@ -3,12 +3,15 @@ package main
 import (
 	"context"
 	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -21,6 +24,7 @@ import (
 	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
 	"github.com/ltcmweb/ltcd/wire"
 	"github.com/ltcmweb/neutrino"
+	"github.com/ltcmweb/neutrino/mwebdb"
 	"github.com/ltcsuite/ltcwallet/walletdb"
 	_ "github.com/ltcsuite/ltcwallet/walletdb/bdb"
 )
@@ -32,12 +36,36 @@ var (
 	serverKey     *ecdh.PrivateKey
 	serverKeyFlag = flag.String("k", "", "ECDH private key")
 
-	port = flag.Int("l", 8080, "Listen port")
+	identityKeyFlag = flag.String("id", "", "Ed25519 identity key seed")
+
+	port      = flag.Int("l", 8080, "Listen port")
+	adminPort = flag.Int("admin-port", 0, "Loopback port serving admin RPCs such as admin_diagnostics (0 = disabled)")
+
+	dataDir      = flag.String("datadir", ".", "Directory for the database and the node list cache")
+	nodesFile    = flag.String("nodes", "", "Local override of the node list")
+	offlineNodes = flag.Bool("offline", false, "Use the cached node list instead of fetching it")
 
 	feeAddress     *mw.StealthAddress
 	feeAddressFlag = flag.String("a", "", "MWEB address to collect fees to")
 
 	forceSwap = flag.Bool("f", false, "Force-run a swap at startup")
+
+	maxWeight = flag.Uint64("w", maxMwebWeight/2, "Max weight of a swap transaction")
+
+	onionTTL = flag.Duration("t", 7*24*time.Hour, "How long a submitted onion is kept")
+
+	rateLimitIP  = flag.Float64("rate-ip", 10, "Max swap requests per minute from one IP (0 = unlimited)")
+	rateLimit    = flag.Float64("rate", 600, "Max swap requests per minute overall (0 = unlimited)")
+	maxQueued    = flag.Int("max-queue", 50_000, "Max onions queued for the next rounds (0 = unlimited)")
+	maxBodySize  = flag.Int("max-body", 1<<20, "Max size of an RPC request body")
+	powBits      = flag.Int("pow", 0, "Leading zero bits of proof of work required per onion")
+	minCoinConfs = flag.Int("min-conf", 0, "Min confirmations of a coin before it can be swapped, unless -policy requires more")
+	policyFile   = flag.String("policy", "", "JSON file configuring the built-in admission policies")
+
+	exportFile = flag.String("export", "", "Export the queued onions to a file and exit")
+	importFile = flag.String("import", "", "Import queued onions from a file once synced")
+	backupKey  = flag.String("backup-key", "",
+		"Operator X25519 key, public to encrypt an export or private to decrypt an import")
 )
 
 func main() {
@@ -65,6 +93,28 @@ func main() {
 		return
 	}
 
+	identitySeed, err := hex.DecodeString(*identityKeyFlag)
+	if err != nil {
+		return
+	}
+	if *identityKeyFlag == "" {
+		identitySeed = make([]byte, ed25519.SeedSize)
+		if _, err = rand.Read(identitySeed); err != nil {
+			return
+		}
+		fmt.Println("Using random identity key", hex.EncodeToString(identitySeed))
+	}
+	if len(identitySeed) != ed25519.SeedSize {
+		err = errors.New("identity key seed must be 32 bytes")
+		return
+	}
+	identityKey = ed25519.NewKeyFromSeed(identitySeed)
+
+	if *maxWeight < minSwapWeight || *maxWeight > maxMwebWeight {
+		err = fmt.Errorf("-w must be between %d and %d", minSwapWeight, maxMwebWeight)
+		return
+	}
+
 	if *feeAddressFlag == "" {
 		err = errors.New("MWEB address for fee collection is required")
 		return
@@ -80,10 +130,44 @@ func main() {
 		return
 	}
 
-	db, err = walletdb.Create("bdb", "neutrino.db", true, time.Minute)
+	if err = os.MkdirAll(*dataDir, 0700); err != nil {
+		return
+	}
+	db, err = walletdb.Create("bdb", filepath.Join(*dataDir, "neutrino.db"), true, time.Minute)
 	if err != nil {
 		return
 	}
+	if err = initDB(db); err != nil {
+		return
+	}
+
+	// Onions queued under the random key of an earlier run can't be
+	// read, but would still count towards -max-queue.
+	if *serverKeyFlag == "" {
+		var n int
+		if n, err = countSealedWithOtherKey(db); err != nil {
+			return
+		}
+		if n > 0 {
+			err = fmt.Errorf("%d queued onions are sealed with another server key, restart with -k set to it", n)
+			return
+		}
+	}
+
+	var keyBytes []byte
+	if keyBytes, err = hex.DecodeString(*backupKey); err != nil {
+		return
+	}
+	if *exportFile != "" {
+		var pubKey *ecdh.PublicKey
+		if len(keyBytes) > 0 {
+			if pubKey, err = ecdh.X25519().NewPublicKey(keyBytes); err != nil {
+				return
+			}
+		}
+		err = exportOnions(*exportFile, pubKey)
+		return
+	}
 
 	cs, err = neutrino.NewChainService(neutrino.Config{
 		Database:    db,
@@ -97,12 +181,22 @@ func main() {
 		return
 	}
 
-	ss := &swapService{}
+	ss := &swapService{limits: newRateLimits()}
+	if ss.policy, err = loadPolicy(*policyFile); err != nil {
+		return
+	}
+	config.CacheDir, config.Offline = *dataDir, *offlineNodes
+	if *nodesFile != "" {
+		if err = config.LoadOverride(*nodesFile); err != nil {
+			return
+		}
+	}
 	if err = ss.getNodes(); err != nil {
 		return
 	}
 
 	rpcServer := rpc.NewServer()
+	rpcServer.SetHTTPBodyLimit(*maxBodySize)
 	rpcServer.RegisterName("swap", ss)
 	http.HandleFunc("/", rpcServer.ServeHTTP)
 	httpServer := &http.Server{
@@ -112,10 +206,29 @@ func main() {
 	}
 	go httpServer.ListenAndServe()
 
-	if *forceSwap {
-		for cs.ConnectedCount() == 0 {
-			time.Sleep(time.Second)
+	if *adminPort > 0 {
+		adminServer := rpc.NewServer()
+		adminServer.RegisterName("admin", &adminService{ss})
+		go http.ListenAndServe(fmt.Sprintf("127.0.0.1:%d", *adminPort), adminServer)
+	}
+
+	go ss.watchTxsForever()
+
+	if *importFile != "" {
+		var privKey *ecdh.PrivateKey
+		if len(keyBytes) > 0 {
+			if privKey, err = ecdh.X25519().NewPrivateKey(keyBytes); err != nil {
+				return
+			}
+		}
+		waitForSync(0)
+		if err = ss.importOnions(*importFile, privKey); err != nil {
+			return
 		}
+	}
+
+	if *forceSwap {
+		waitForSync(0)
 		if err = ss.performSwap(); err != nil {
 			return
 		}
@@ -135,6 +248,12 @@ func main() {
 			height = height2
 		}
 
+		if t.Hour() != tPrev.Hour() {
+			if err = pruneOnions(); err != nil {
+				return
+			}
+		}
+
 		switch {
 		case tPrev.Hour() == 23 && t.Hour() == 0:
 			err = ss.performSwap()
@@ -151,7 +270,15 @@ type swapService struct {
 	mu        sync.Mutex
 	nodes     []config.Node
 	nodeIndex int
-	onions    map[mw.Commitment]*onionEtc
+	agreed    *agreedRound
+	proposals map[string]time.Time
+
+	roundMu    sync.Mutex
+	round      *round
+	recoveries int
+
+	limits *rateLimits
+	policy policies
 }
 
 func (s *swapService) getNodes() error {
@@ -160,8 +287,9 @@ func (s *swapService) getNodes() error {
 
 	pubKey := serverKey.PublicKey()
 	fmt.Println("Public key =", hex.EncodeToString(pubKey.Bytes()))
+	fmt.Println("Identity key =", hex.EncodeToString(identityKey.Public().(ed25519.PublicKey)))
 
-	s.nodes, s.nodeIndex = config.AliveNodes(context.Background(), pubKey)
+	s.nodes, s.nodeIndex = config.AliveNodes(context.Background(), pubKey, network)
 
 	if s.nodeIndex < 0 {
 		return errors.New("public key not found in config")
@@ -170,21 +298,77 @@ func (s *swapService) getNodes() error {
 	return nil
 }
 
-func (s *swapService) Swap(onion onion.Onion) error {
+// Swap never waits on a running round. The round works from the onions
+// it loaded when it started, so anything saved now is staged for the next.
+// The optional expiry is a unix time after which the onion won't be mixed,
+// and the nonce is the proof of work, if the node requires one.
+func (s *swapService) Swap(ctx context.Context,
+	onion onion.Onion, expiry, nonce *uint64) error {
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	nodeIndex := s.nodeIndex
+	s.mu.Unlock()
 
-	if s.nodeIndex != 0 {
+	if nodeIndex != 0 {
 		return errors.New("node index is not zero")
 	}
+	if err := s.admit(ctx, &onion, nonce); err != nil {
+		return err
+	}
+	q := &queuedOnion{Onion: &onion, Submitted: time.Now()}
+	if expiry != nil {
+		q.Expiry = fromUnixTime(*expiry)
+		if q.expired(q.Submitted) {
+			return errors.New("onion already expired")
+		}
+	}
 	if err := validateOnion(&onion); err != nil {
 		return err
 	}
-	return saveOnion(db, &onion)
+	if err := s.policy.Admit(ctx, &onion); err != nil {
+		return err
+	}
+	return saveOnion(db, q)
+}
+
+// admit applies the cheap checks that guard validateOnion from floods.
+func (s *swapService) admit(ctx context.Context, onion *onion.Onion, nonce *uint64) error {
+	addr := rpc.PeerInfoFromContext(ctx).RemoteAddr
+	if !s.limits.allow(addr, *rateLimitIP, *rateLimit) {
+		return errRateLimited
+	}
+	// A coin DB that is behind would have us reject valid onions.
+	if !isSynced() {
+		return errNotSynced
+	}
+	if err := checkQueue(); err != nil {
+		return err
+	}
+	if *powBits > 0 && (nonce == nil || !checkWork(onion, *nonce, *powBits)) {
+		return errInsufficientWork
+	}
+	return nil
 }
 
-func inputFromOnion(onion *onion.Onion) (input *wire.MwebInput, err error) {
-	defer func() { err, _ = recover().(error) }()
+// checkQueue returns errQueueFull once -max-queue onions are queued.
+func checkQueue() error {
+	if *maxQueued <= 0 {
+		return nil
+	}
+	n, err := countOnions(db)
+	if err != nil {
+		return err
+	}
+	if n >= *maxQueued {
+		return errQueueFull
+	}
+	return nil
+}
+
+func inputFromOnion(onion *onion.Onion) (*wire.MwebInput, error) {
+	if err := onion.CheckSizes(); err != nil {
+		return nil, err
+	}
 	return &wire.MwebInput{
 		Features:     wire.MwebInputStealthKeyFeatureBit,
 		OutputId:     chainhash.Hash(onion.Input.OutputId),
@@ -195,6 +379,21 @@ func inputFromOnion(onion *onion.Onion) (input *wire.MwebInput, err error) {
 	}, nil
 }
 
+// transientError marks a validation failure that may go away, such as
+// a coin missing because the coin DB is behind or was rolled back by a
+// reorg. Onions failing this way are kept and checked again next round.
+type transientError struct{ error }
+
+// errCoinLookup marks a failure to read the coin DB, which says nothing
+// about the onion itself.
+var errCoinLookup = errors.New("coin lookup failed")
+
+func (e transientError) Unwrap() error { return e.error }
+
+func isTransient(err error) bool {
+	return errors.As(err, &transientError{})
+}
+
 func validateOnion(onion *onion.Onion) error {
 	input, err := inputFromOnion(onion)
 	if err != nil {
@@ -202,8 +401,13 @@ func validateOnion(onion *onion.Onion) error {
 	}
 
 	output, err := cs.MwebCoinDB.FetchCoin(&input.OutputId)
-	if err != nil {
+	switch {
+	case errors.Is(err, mwebdb.ErrCoinNotFound) && !coinsSettled():
+		return transientError{err}
+	case errors.Is(err, mwebdb.ErrCoinNotFound):
 		return err
+	case err != nil:
+		return fmt.Errorf("%w: %v", errCoinLookup, err)
 	}
 
 	if input.Commitment != output.Commitment {
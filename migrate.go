@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+)
+
+// migrations upgrade the coinswap buckets from one schema version to the
+// next, in order. The schema version is the number of migrations that
+// have been applied, so new ones must only ever be appended.
+var migrations = []func(walletdb.ReadWriteTx) error{
+	migrateLegacyBuckets,
+	migrateOnionEncoding,
+	migrateOnionTimes,
+	migrateSealOnions,
+	migrateOnionCount,
+}
+
+// initDB creates the coinswap buckets if needed and brings them up to
+// the current schema version. Each migration commits along with the
+// version it results in, so an interrupted upgrade resumes where it left off.
+func initDB(db walletdb.DB) error {
+	for {
+		done := false
+		err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+			bucket, err := tx.CreateTopLevelBucket(coinswapBucket)
+			if err != nil {
+				return err
+			}
+			version, err := schemaVersion(bucket)
+			if err != nil {
+				return err
+			}
+			if version > len(migrations) {
+				return fmt.Errorf("database schema version %d is newer "+
+					"than supported version %d", version, len(migrations))
+			}
+			if version == len(migrations) {
+				done = true
+				return nil
+			}
+			if err = migrations[version](tx); err != nil {
+				return fmt.Errorf("migration %d: %w", version+1, err)
+			}
+			return putSchemaVersion(bucket, version+1)
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func schemaVersion(bucket walletdb.ReadBucket) (int, error) {
+	v := bucket.Get(versionKey)
+	switch len(v) {
+	case 0:
+		return 0, nil
+	case 4:
+		return int(binary.BigEndian.Uint32(v)), nil
+	}
+	return 0, fmt.Errorf("bad schema version %x", v)
+}
+
+func putSchemaVersion(bucket walletdb.ReadWriteBucket, version int) error {
+	return bucket.Put(versionKey, binary.BigEndian.AppendUint32(nil, uint32(version)))
+}
+
+var (
+	legacyOnionsBucket = []byte("coinswap-onions")
+	legacyTxsBucket    = []byte("coinswap-txs")
+)
+
+// migrateLegacyBuckets moves the top-level buckets used before the
+// schema was versioned into the coinswap bucket.
+func migrateLegacyBuckets(tx walletdb.ReadWriteTx) error {
+	for _, b := range []struct{ from, to []byte }{
+		{legacyOnionsBucket, onionsBucket},
+		{legacyTxsBucket, txsBucket},
+	} {
+		to, err := tx.ReadWriteBucket(coinswapBucket).CreateBucketIfNotExists(b.to)
+		if err != nil {
+			return err
+		}
+		from := tx.ReadBucket(b.from)
+		if from == nil {
+			continue
+		}
+		err = from.ForEach(func(k, v []byte) error {
+			return to.Put(bytes.Clone(k), bytes.Clone(v))
+		})
+		if err != nil {
+			return err
+		}
+		if err = tx.DeleteTopLevelBucket(b.from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateOnionEncoding re-encodes stored onions from gob to the
+// onion package's binary encoding. Onions that can't be re-encoded are
+// moved to the quarantine bucket, rather than failing the migration.
+func migrateOnionEncoding(tx walletdb.ReadWriteTx) error {
+	bucket := writeBucket(tx, onionsBucket)
+	values := map[string][]byte{}
+	quarantined := map[string][]byte{}
+	err := bucket.ForEach(func(k, v []byte) error {
+		var onion *onion.Onion
+		err := gob.NewDecoder(bytes.NewReader(v)).Decode(&onion)
+		var buf bytes.Buffer
+		if err == nil {
+			err = onion.Serialize(&buf)
+		}
+		if err != nil {
+			fmt.Printf("Quarantining onion %x: %v\n", k, err)
+			quarantined[string(k)] = bytes.Clone(v)
+			return nil
+		}
+		values[string(k)] = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		if err = bucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	if len(quarantined) == 0 {
+		return nil
+	}
+	quarantine, err := tx.ReadWriteBucket(coinswapBucket).CreateBucketIfNotExists(quarantineBucket)
+	if err != nil {
+		return err
+	}
+	for k, v := range quarantined {
+		if err = quarantine.Put([]byte(k), v); err != nil {
+			return err
+		}
+		if err = bucket.Delete([]byte(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateOnionTimes prefixes stored onions with their submission time
+// and expiry. Onions queued before this have their TTL start now.
+func migrateOnionTimes(tx walletdb.ReadWriteTx) error {
+	bucket := writeBucket(tx, onionsBucket)
+	values := map[string][]byte{}
+	now := unixTime(time.Now())
+	err := bucket.ForEach(func(k, v []byte) error {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, now)
+		binary.Write(&buf, binary.BigEndian, uint64(0))
+		buf.Write(v)
+		values[string(k)] = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		if err = bucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSealOnions encrypts stored onions with the server key.
+func migrateSealOnions(tx walletdb.ReadWriteTx) error {
+	bucket := writeBucket(tx, onionsBucket)
+	values := map[string][]byte{}
+	err := bucket.ForEach(func(k, v []byte) (err error) {
+		values[string(k)], err = sealValue(k, v)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		if err = bucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateOnionCount stores the number of queued onions.
+func migrateOnionCount(tx walletdb.ReadWriteTx) error {
+	n := 0
+	err := writeBucket(tx, onionsBucket).ForEach(func(k, v []byte) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return putOnionCount(tx, n)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/gob"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcsuite/ltcwallet/walletdb"
+)
+
+func testDB(t *testing.T) walletdb.DB {
+	db, err := walletdb.Create("bdb",
+		filepath.Join(t.TempDir(), "test.db"), true, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// useTestDB points the package's db at a fresh test DB for the length
+// of the test.
+func useTestDB(t *testing.T) {
+	old := db
+	db = testDB(t)
+	t.Cleanup(func() { db = old })
+}
+
+func dbVersion(t *testing.T, db walletdb.DB) (version int) {
+	err := walletdb.View(db, func(tx walletdb.ReadTx) (err error) {
+		version, err = schemaVersion(tx.ReadBucket(coinswapBucket))
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// testSignedOnion creates an onion that carries an (unspendable) input
+// and a valid owner proof for it.
+func testSignedOnion(t *testing.T) *onion.Onion {
+	_, o := testOnion(t)
+	spendKey := randSecretKey()
+	o.Onion.Sign(&wire.MwebInput{
+		OutputId:     chainhash.Hash(*randSecretKey()),
+		Commitment:   *mw.NewCommitment((*mw.BlindingFactor)(randSecretKey()), 1),
+		InputPubKey:  randSecretKey().PubKey(),
+		OutputPubKey: *spendKey.PubKey(),
+	}, spendKey)
+	return o.Onion
+}
+
+func TestInitDB(t *testing.T) {
+	db := testDB(t)
+	for range 2 {
+		if err := initDB(db); err != nil {
+			t.Fatal(err)
+		}
+		if v := dbVersion(t, db); v != len(migrations) {
+			t.Fatal("schema version", v)
+		}
+	}
+
+	onions, err := loadOnions(db)
+	if err != nil || len(onions) > 0 {
+		t.Fatal(onions, err)
+	}
+	txs, err := loadTxs(db)
+	if err != nil || len(txs) > 0 {
+		t.Fatal(txs, err)
+	}
+}
+
+func TestInitDBNewerVersion(t *testing.T) {
+	db := testDB(t)
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		bucket, err := tx.CreateTopLevelBucket(coinswapBucket)
+		if err != nil {
+			return err
+		}
+		return putSchemaVersion(bucket, len(migrations)+1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = initDB(db); err == nil {
+		t.Fatal("expected newer version error")
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	db := testDB(t)
+	onion := testSignedOnion(t)
+	r := &txRecord{Hash: chainhash.Hash{1}, Status: txPending}
+
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		for _, b := range []struct {
+			name, key []byte
+			value     any
+		}{
+			{legacyOnionsBucket, onion.Input.Commitment, onion},
+			{legacyTxsBucket, r.Hash[:], r},
+		} {
+			bucket, err := tx.CreateTopLevelBucket(b.name)
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err = gob.NewEncoder(&buf).Encode(b.value); err != nil {
+				return err
+			}
+			if err = bucket.Put(b.key, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = initDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	onions, err := loadOnions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onions) != 1 || !onions[0].VerifySig() ||
+		!bytes.Equal(onions[0].Payloads, onion.Payloads) {
+		t.Fatal("onion not migrated")
+	}
+	if n, err := countOnions(db); err != nil || n != 1 {
+		t.Fatal("onion count", n, err)
+	}
+	txs, err := loadTxs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || txs[0].Hash != r.Hash || txs[0].Status != txPending {
+		t.Fatal("tx not migrated")
+	}
+
+	walletdb.View(db, func(tx walletdb.ReadTx) error {
+		if tx.ReadBucket(legacyOnionsBucket) != nil ||
+			tx.ReadBucket(legacyTxsBucket) != nil {
+			t.Fatal("legacy buckets not removed")
+		}
+		return nil
+	})
+}
+
+func TestMigrateBadOnions(t *testing.T) {
+	db := testDB(t)
+	good, bad := testSignedOnion(t), testSignedOnion(t)
+	bad.Input.OutputId = bad.Input.OutputId[:31]
+
+	err := walletdb.Update(db, func(tx walletdb.ReadWriteTx) error {
+		bucket, err := tx.CreateTopLevelBucket(legacyOnionsBucket)
+		if err != nil {
+			return err
+		}
+		for _, onion := range []*onion.Onion{good, bad} {
+			var buf bytes.Buffer
+			if err = gob.NewEncoder(&buf).Encode(onion); err != nil {
+				return err
+			}
+			if err = bucket.Put(onion.Input.Commitment, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("garbage"), []byte{1, 2, 3})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	onions, err := loadOnions(db)
+	if err != nil || len(onions) != 1 ||
+		!bytes.Equal(onions[0].Input.Commitment, good.Input.Commitment) {
+		t.Fatal("good onion not migrated", err)
+	}
+	walletdb.View(db, func(tx walletdb.ReadTx) error {
+		n := 0
+		readBucket(tx, quarantineBucket).ForEach(func(k, v []byte) error {
+			n++
+			return nil
+		})
+		if n != 2 {
+			t.Fatal("bad onions not quarantined", n)
+		}
+		return nil
+	})
+}
+
+func TestPruneOnions(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	fresh := &queuedOnion{Onion: testSignedOnion(t), Submitted: now}
+	for _, q := range []*queuedOnion{
+		fresh,
+		{Onion: testSignedOnion(t), Submitted: now.Add(-*onionTTL - time.Second)},
+		{Onion: testSignedOnion(t), Submitted: now, Expiry: now.Add(-time.Second)},
+	} {
+		if err := saveOnion(db, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pruneOnions(); err != nil {
+		t.Fatal(err)
+	}
+	onions, err := loadOnions(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onions) != 1 || !bytes.Equal(onions[0].Payloads, fresh.Payloads) ||
+		!onions[0].Submitted.Equal(now) || !onions[0].Expiry.IsZero() {
+		t.Fatal("wrong onions pruned")
+	}
+	if n, err := countOnions(db); err != nil || n != 1 {
+		t.Fatal("onion count", n, err)
+	}
+}
+
+func TestSealedOnions(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	q := &queuedOnion{Onion: testSignedOnion(t), Submitted: time.Now()}
+	if err := saveOnion(db, q); err != nil {
+		t.Fatal(err)
+	}
+
+	walletdb.View(db, func(tx walletdb.ReadTx) error {
+		v := readBucket(tx, onionsBucket).Get(q.Input.Commitment)
+		if bytes.Contains(v, q.OwnerProof) || bytes.Contains(v, q.Payloads[:64]) {
+			t.Fatal("onion stored in the clear")
+		}
+		return nil
+	})
+
+	key := serverKey
+	defer func() { serverKey = key }()
+	serverKey, _ = ecdh.X25519().GenerateKey(rand.Reader)
+	onions, err := loadOnions(db)
+	if err != nil || len(onions) > 0 {
+		t.Fatal("loaded onion sealed with another key", err)
+	}
+	if err = pruneOnions(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := countSealedWithOtherKey(db); n != 1 {
+		t.Fatal("onion sealed with another key not kept")
+	}
+
+	serverKey = key
+	if onions, err = loadOnions(db); err != nil || len(onions) != 1 {
+		t.Fatal("onion not recovered with the original key", err)
+	}
+}
@@ -0,0 +1,38 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrMalformed = errors.New("malformed")
+	ErrTooLarge  = errors.New("too large")
+	ErrVersion   = errors.New("unknown version")
+	ErrOverflow  = errors.New("scalar overflowed")
+	ErrLength    = errors.New("wrong length")
+)
+
+// ParseError describes a field of an onion that could not be parsed.
+// The underlying error is one of the above, or an io error for input
+// that was cut short.
+type ParseError struct {
+	Field string
+	Err   error
+}
+
+func parseError(field string, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &ParseError{field, err}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("onion %s: %v", e.Field, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,107 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func fuzzKey(f *testing.F) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().NewPrivateKey(make([]byte, 32))
+	if err != nil {
+		f.Fatal(err)
+	}
+	return key
+}
+
+func FuzzPeel(f *testing.F) {
+	key := fuzzKey(f)
+	hops, _ := testHops(f, 2)
+	hops[0].PubKey = key.PublicKey()
+	for _, newOnion := range []func([]*Hop) (*Onion, error){New, NewV1, NewV2} {
+		onion, err := newOnion(hops)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add([]byte(onion.PubKey), []byte(onion.Payloads))
+	}
+	f.Add(make([]byte, 32), make([]byte, 8))
+
+	f.Fuzz(func(t *testing.T, pubKey, payloads []byte) {
+		onion := &Onion{PubKey: pubKey, Payloads: payloads}
+		hop, next, err := onion.Peel(key)
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) && !errors.Is(err, ErrMacMismatch) {
+				t.Fatalf("untyped error %v", err)
+			}
+			return
+		}
+		if hop == nil || next == nil || len(next.PubKey) != 32 {
+			t.Fatal("bad peel result")
+		}
+	})
+}
+
+func FuzzUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`{"input":{"output_id":"00"},"enc_payloads":"","ephemeral_xpub":"","owner_proof":""}`))
+	f.Add([]byte(`{}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var onion Onion
+		if json.Unmarshal(data, &onion) != nil {
+			return
+		}
+		if err := onion.CheckSizes(); err != nil {
+			t.Fatal(err)
+		}
+		onion.VerifySig()
+	})
+}
+
+func FuzzVerifySig(f *testing.F) {
+	f.Add(make([]byte, 33), make([]byte, 33), make([]byte, 64), []byte{})
+
+	f.Fuzz(func(t *testing.T, inputPubKey, outputPubKey, ownerProof, payloads []byte) {
+		onion := &Onion{Payloads: payloads, OwnerProof: ownerProof}
+		onion.Input.InputPubKey = inputPubKey
+		onion.Input.OutputPubKey = outputPubKey
+		if onion.VerifySig() {
+			t.Fatal("forged signature verified")
+		}
+	})
+}
+
+func FuzzDeserialize(f *testing.F) {
+	hops, _ := testHops(f, 1)
+	onion, err := New(hops)
+	if err != nil {
+		f.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = onion.Serialize(&buf); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte{0, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var onion Onion
+		if err := onion.Deserialize(bytes.NewReader(data)); err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("untyped error %v", err)
+			}
+			return
+		}
+		var buf bytes.Buffer
+		if err := onion.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[:buf.Len()]) {
+			t.Fatal("round trip mismatch")
+		}
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"io"
 
 	"github.com/decred/dcrd/dcrec/secp256k1/v4"
 	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
@@ -54,75 +55,298 @@ func (h *hexBytes) UnmarshalJSON(data []byte) (err error) {
 	return
 }
 
-func New(hops []*Hop) (*Onion, error) {
-	privKey, err := ecdh.X25519().GenerateKey(rand.Reader)
-	if err != nil {
+const (
+	// MaxHops is the number of hops a version 1 onion has room for.
+	MaxHops = 8
+
+	// PayloadSize is the size of each hop's slot in a version 1 onion.
+	PayloadSize = 1024
+
+	// MaxPayloadsSize bounds the encrypted payloads of any onion version.
+	MaxPayloadsSize = 1 << 16
+)
+
+func (hop *Hop) serialize(ver byte, nextPubKey []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(ver)
+	buf.Write(nextPubKey)
+	buf.Write(hop.KernelBlind[:])
+	buf.Write(hop.StealthBlind[:])
+	binary.Write(&buf, binary.BigEndian, hop.Fee)
+
+	if hop.Output != nil {
+		buf.WriteByte(1)
+		hop.Output.Serialize(&buf)
+	} else {
+		buf.WriteByte(0)
+	}
+
+	return buf.Bytes()
+}
+
+type layer struct {
+	cipher  *chacha20.Cipher
+	macKey  []byte
+	payload []byte
+}
+
+// generateKey reads an X25519 key from rng directly, since crypto/ecdh
+// ignores readers other than crypto/rand.Reader.
+func generateKey(rng io.Reader) (*ecdh.PrivateKey, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rng, key); err != nil {
 		return nil, err
 	}
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+func newLayers(rng io.Reader, ver byte, hops []*Hop) (*Onion, []*layer, error) {
+	privKey, err := generateKey(rng)
+	if err != nil {
+		return nil, nil, err
+	}
 	onion := &Onion{PubKey: privKey.PublicKey().Bytes()}
 
-	var (
-		ciphers  []*chacha20.Cipher
-		payloads [][]byte
-	)
+	var layers []*layer
 	for i, hop := range hops {
-		cipher, err := NewCipher(privKey, hop.PubKey)
-		if err != nil {
-			return nil, err
-		}
-		ciphers = append(ciphers, cipher)
-
-		privKey, err = ecdh.X25519().GenerateKey(rand.Reader)
+		cipher, macKey, err := sharedKeys(privKey, hop.PubKey)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		var buf bytes.Buffer
-		buf.WriteByte(0)
+		nextPubKey := make([]byte, 32)
 		if i < len(hops)-1 {
-			buf.Write(privKey.PublicKey().Bytes())
-		} else {
-			buf.Write(make([]byte, 32))
+			if privKey, err = generateKey(rng); err != nil {
+				return nil, nil, err
+			}
+			nextPubKey = privKey.PublicKey().Bytes()
 		}
+		layers = append(layers, &layer{cipher, macKey, hop.serialize(ver, nextPubKey)})
+	}
 
-		buf.Write(hop.KernelBlind[:])
-		buf.Write(hop.StealthBlind[:])
-		binary.Write(&buf, binary.BigEndian, hop.Fee)
+	return onion, layers, nil
+}
 
-		if hop.Output != nil {
-			buf.WriteByte(1)
-			hop.Output.Serialize(&buf)
-		} else {
-			buf.WriteByte(0)
+func (onion *Onion) UnmarshalJSON(data []byte) error {
+	type plain Onion
+	if err := json.Unmarshal(data, (*plain)(onion)); err != nil {
+		return err
+	}
+	return onion.CheckSizes()
+}
+
+// CheckSizes verifies that every field of a submitted onion has the
+// length of the value it holds, so that it can be converted safely.
+func (onion *Onion) CheckSizes() error {
+	fields := []struct {
+		name string
+		b    []byte
+		n    int
+	}{
+		{"output_id", onion.Input.OutputId, 32},
+		{"output_commit", onion.Input.Commitment, 33},
+		{"output_pk", onion.Input.OutputPubKey, 33},
+		{"input_pk", onion.Input.InputPubKey, 33},
+		{"input_sig", onion.Input.Signature, 64},
+		{"ephemeral_xpub", onion.PubKey, 32},
+		{"owner_proof", onion.OwnerProof, 64},
+	}
+	for _, f := range fields {
+		if len(f.b) != f.n {
+			return parseError(f.name, ErrLength)
 		}
+	}
+	if len(onion.Payloads) > MaxPayloadsSize {
+		return parseError("enc_payloads", ErrTooLarge)
+	}
+	return nil
+}
 
-		payloads = append(payloads, buf.Bytes())
+func New(hops []*Hop) (*Onion, error) {
+	return NewWithRand(rand.Reader, 0, hops)
+}
+
+// NewV1 creates a version 1 onion, where every hop's payload is padded
+// to PayloadSize and the onion always has room for MaxHops of them. As
+// in Sphinx, each node shifts out its own slot and appends random bytes,
+// so the size of an onion reveals nothing about its position in the route.
+func NewV1(hops []*Hop) (*Onion, error) {
+	return NewWithRand(rand.Reader, 1, hops)
+}
+
+// NewV2 creates a version 2 onion. It has the fixed layout of version 1,
+// but each slot also carries a MAC over the whole of the next node's
+// encrypted payloads, and the first MAC is sent alongside the onion.
+// The padding appended on each peel is derived from the keystream
+// rather than being random, so that the sender can compute every MAC
+// up front. A node can thus detect that its layer, or anything it is
+// about to forward, was tampered with by someone earlier on the route.
+func NewV2(hops []*Hop) (*Onion, error) {
+	return NewWithRand(rand.Reader, 2, hops)
+}
+
+// NewWithRand creates an onion of the given version, taking the
+// ephemeral keys and then any padding from rng. Given the same
+// randomness, it always produces the same onion, which is what the
+// test vectors rely on.
+func NewWithRand(rng io.Reader, ver byte, hops []*Hop) (*Onion, error) {
+	switch ver {
+	case 0:
+		return newV0(rng, hops)
+	case 1:
+		return newV1(rng, hops)
+	case 2:
+		return newV2(rng, hops)
 	}
+	return nil, ErrVersion
+}
 
-	for i := len(payloads) - 1; i >= 0; i-- {
-		for j := i; j < len(payloads); j++ {
-			ciphers[i].XORKeyStream(payloads[j], payloads[j])
+func newV0(rng io.Reader, hops []*Hop) (*Onion, error) {
+	onion, layers, err := newLayers(rng, 0, hops)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		for j := i; j < len(layers); j++ {
+			layers[i].cipher.XORKeyStream(layers[j].payload, layers[j].payload)
 		}
 	}
 
 	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, uint64(len(payloads)))
-	for _, payload := range payloads {
-		binary.Write(&buf, binary.BigEndian, uint64(len(payload)))
-		buf.Write(payload)
+	binary.Write(&buf, binary.BigEndian, uint64(len(layers)))
+	for _, layer := range layers {
+		binary.Write(&buf, binary.BigEndian, uint64(len(layer.payload)))
+		buf.Write(layer.payload)
 	}
 	onion.Payloads = buf.Bytes()
 	return onion, nil
 }
 
-func NewCipher(privKey *ecdh.PrivateKey, pubKey *ecdh.PublicKey) (*chacha20.Cipher, error) {
-	secret, err := privKey.ECDH(pubKey)
+func newV1(rng io.Reader, hops []*Hop) (*Onion, error) {
+	if len(hops) > MaxHops {
+		return nil, errors.New("too many hops")
+	}
+	onion, layers, err := newLayers(rng, 1, hops)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := make([]byte, MaxHops*PayloadSize)
+	if _, err = io.ReadFull(rng, blob); err != nil {
+		return nil, err
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if len(layers[i].payload) > PayloadSize {
+			return nil, errors.New("hop payload too large")
+		}
+		copy(blob[PayloadSize:], blob)
+		copy(blob, layers[i].payload)
+		clear(blob[len(layers[i].payload):PayloadSize])
+		layers[i].cipher.XORKeyStream(blob, blob)
+	}
+
+	onion.Payloads = append([]byte{1}, blob...)
+	return onion, nil
+}
+
+// ErrMacMismatch is returned by Peel when a version 2 onion was modified
+// after it left the sender. As the previous node was the last to handle
+// it, this points at that node (or at the sender) being dishonest.
+var ErrMacMismatch = errors.New("onion mac mismatch")
+
+const (
+	macSize    = sha256.Size
+	slotSizeV2 = PayloadSize + macSize
+	blobSizeV2 = MaxHops * slotSizeV2
+)
+
+func computeMac(key, blob []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(blob)
+	return h.Sum(nil)
+}
+
+func newV2(rng io.Reader, hops []*Hop) (*Onion, error) {
+	if len(hops) > MaxHops {
+		return nil, errors.New("too many hops")
+	}
+	onion, layers, err := newLayers(rng, 2, hops)
 	if err != nil {
 		return nil, err
 	}
+
+	keystreams := make([][]byte, len(layers))
+	for i, layer := range layers {
+		if len(layer.payload) > PayloadSize {
+			return nil, errors.New("hop payload too large")
+		}
+		keystreams[i] = make([]byte, blobSizeV2+slotSizeV2)
+		layer.cipher.XORKeyStream(keystreams[i], keystreams[i])
+	}
+
+	// The filler is what the tail of the last node's payloads will be
+	// after the padding added by each earlier node has been decrypted.
+	var filler []byte
+	for i := 0; i < len(layers)-1; i++ {
+		filler = append(filler, make([]byte, slotSizeV2)...)
+		ks := keystreams[i][blobSizeV2+slotSizeV2-len(filler):]
+		for j := range filler {
+			filler[j] ^= ks[j]
+		}
+	}
+
+	blob := make([]byte, blobSizeV2)
+	if _, err = io.ReadFull(rng, blob[:blobSizeV2-len(filler)]); err != nil {
+		return nil, err
+	}
+	copy(blob[blobSizeV2-len(filler):], filler)
+
+	mac := make([]byte, macSize)
+	for i := len(layers) - 1; i >= 0; i-- {
+		slot := make([]byte, slotSizeV2)
+		copy(slot, layers[i].payload)
+		copy(slot[PayloadSize:], mac)
+
+		// The last node's filler is left as is, having been
+		// computed from the earlier nodes' keystreams.
+		n := blobSizeV2 - len(filler)
+		if i < len(layers)-1 {
+			copy(blob[slotSizeV2:], blob)
+			n = blobSizeV2
+		}
+		copy(blob, slot)
+		for j := range n {
+			blob[j] ^= keystreams[i][j]
+		}
+		mac = computeMac(layers[i].macKey, blob)
+	}
+
+	onion.Payloads = append(append([]byte{2}, mac...), blob...)
+	return onion, nil
+}
+
+func sharedKeys(privKey *ecdh.PrivateKey, pubKey *ecdh.PublicKey) (
+	cipher *chacha20.Cipher, macKey []byte, err error) {
+
+	secret, err := privKey.ECDH(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
 	h := hmac.New(sha256.New, []byte("MWIXNET"))
 	h.Write(secret)
-	return chacha20.NewUnauthenticatedCipher(h.Sum(nil), []byte("NONCE1234567"))
+	cipher, err = chacha20.NewUnauthenticatedCipher(h.Sum(nil), []byte("NONCE1234567"))
+	if err != nil {
+		return nil, nil, err
+	}
+	h = hmac.New(sha256.New, []byte("MWIXNET-MAC"))
+	h.Write(secret)
+	return cipher, h.Sum(nil), nil
+}
+
+func NewCipher(privKey *ecdh.PrivateKey, pubKey *ecdh.PublicKey) (*chacha20.Cipher, error) {
+	cipher, _, err := sharedKeys(privKey, pubKey)
+	return cipher, err
 }
 
 func (onion *Onion) Sign(input *wire.MwebInput, spendKey *mw.SecretKey) {
@@ -167,32 +391,123 @@ func (onion *Onion) VerifySig() bool {
 }
 
 func (onion *Onion) Peel(privKey *ecdh.PrivateKey) (*Hop, *Onion, error) {
+	if len(onion.Payloads) > MaxPayloadsSize {
+		return nil, nil, parseError("enc_payloads", ErrTooLarge)
+	}
 	pubKey, err := ecdh.X25519().NewPublicKey(onion.PubKey)
+	if err != nil {
+		return nil, nil, parseError("ephemeral_xpub", err)
+	}
+	cipher, macKey, err := sharedKeys(privKey, pubKey)
+	if err != nil {
+		return nil, nil, parseError("ephemeral_xpub", err)
+	}
+
+	var (
+		ver               byte
+		payload, payloads []byte
+	)
+	if len(onion.Payloads) > 0 {
+		ver = onion.Payloads[0]
+	}
+	switch ver {
+	case 0:
+		payload, payloads, err = peelV0(cipher, onion.Payloads)
+	case 1:
+		payload, payloads, err = peelV1(cipher, onion.Payloads)
+	case 2:
+		payload, payloads, err = peelV2(cipher, macKey, onion.Payloads)
+	default:
+		err = parseError("enc_payloads", ErrVersion)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
-	cipher, err := NewCipher(privKey, pubKey)
+
+	hop, pubKeyBytes, err := parseHop(ver, payload)
 	if err != nil {
 		return nil, nil, err
 	}
+	return hop, &Onion{Payloads: payloads, PubKey: pubKeyBytes}, nil
+}
+
+func parseHop(ver byte, payload []byte) (*Hop, []byte, error) {
+	r := bytes.NewReader(payload)
+	if v, err := r.ReadByte(); err != nil {
+		return nil, nil, parseError("version", err)
+	} else if v != ver {
+		return nil, nil, parseError("version", ErrVersion)
+	}
+
+	var (
+		hop    = &Hop{}
+		pubKey = make([]byte, 32)
+	)
+	if _, err := io.ReadFull(r, pubKey); err != nil {
+		return nil, nil, parseError("next pubkey", err)
+	}
+	if _, err := io.ReadFull(r, hop.KernelBlind[:]); err != nil {
+		return nil, nil, parseError("kernel blind", err)
+	}
+	if _, err := io.ReadFull(r, hop.StealthBlind[:]); err != nil {
+		return nil, nil, parseError("stealth blind", err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &hop.Fee); err != nil {
+		return nil, nil, parseError("fee", err)
+	}
+
+	var k secp256k1.ModNScalar
+	if k.SetBytes((*[32]byte)(&hop.KernelBlind)) > 0 {
+		return nil, nil, parseError("kernel blind", ErrOverflow)
+	}
+	if k.SetBytes((*[32]byte)(&hop.StealthBlind)) > 0 {
+		return nil, nil, parseError("stealth blind", ErrOverflow)
+	}
 
+	hasOutput, err := r.ReadByte()
+	if err != nil {
+		return nil, nil, parseError("output", err)
+	}
+	switch hasOutput {
+	case 0:
+	case 1:
+		hop.Output = &wire.MwebOutput{}
+		if err = hop.Output.Deserialize(r); err != nil {
+			return nil, nil, parseError("output", err)
+		}
+	default:
+		return nil, nil, parseError("output", ErrMalformed)
+	}
+
+	return hop, pubKey, nil
+}
+
+func peelV0(cipher *chacha20.Cipher, data []byte) (payload, rest []byte, err error) {
 	var (
 		count, size uint64
-		payload     []byte
 		payloads    bytes.Buffer
 	)
-	r := bytes.NewReader(onion.Payloads)
+	r := bytes.NewReader(data)
 	if err = binary.Read(r, binary.BigEndian, &count); err != nil {
-		return nil, nil, err
+		return nil, nil, parseError("hop count", err)
+	}
+	if count == 0 {
+		return nil, nil, parseError("hop count", ErrMalformed)
+	}
+	if count > MaxHops {
+		return nil, nil, parseError("hop count", ErrTooLarge)
 	}
 	binary.Write(&payloads, binary.BigEndian, count-1)
 	for i := uint64(0); i < count; i++ {
 		if err = binary.Read(r, binary.BigEndian, &size); err != nil {
-			return nil, nil, err
+			return nil, nil, parseError("payload size", err)
+		}
+		if size > uint64(r.Len()) {
+			return nil, nil, parseError("payload size", io.ErrUnexpectedEOF)
 		}
 		buf := make([]byte, size)
-		if _, err = r.Read(buf); err != nil {
-			return nil, nil, err
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, nil, parseError("payload", err)
 		}
 		cipher.XORKeyStream(buf, buf)
 		if i == 0 {
@@ -202,53 +517,41 @@ func (onion *Onion) Peel(privKey *ecdh.PrivateKey) (*Hop, *Onion, error) {
 			payloads.Write(buf)
 		}
 	}
-
-	r = bytes.NewReader(payload)
-	ver, err := r.ReadByte()
-	if err != nil {
-		return nil, nil, err
-	}
-	if ver != 0 {
-		return nil, nil, errors.New("wrong onion version")
+	if r.Len() > 0 {
+		return nil, nil, parseError("enc_payloads", ErrMalformed)
 	}
+	return payload, payloads.Bytes(), nil
+}
 
-	onion = &Onion{
-		Payloads: payloads.Bytes(),
-		PubKey:   make([]byte, 32),
-	}
-	if _, err = r.Read(onion.PubKey); err != nil {
-		return nil, nil, err
+func peelV1(cipher *chacha20.Cipher, data []byte) (payload, rest []byte, err error) {
+	if len(data) != 1+MaxHops*PayloadSize {
+		return nil, nil, parseError("enc_payloads", ErrMalformed)
 	}
+	blob := make([]byte, MaxHops*PayloadSize)
+	cipher.XORKeyStream(blob, data[1:])
 
-	hop := &Hop{}
-	if _, err = r.Read(hop.KernelBlind[:]); err != nil {
-		return nil, nil, err
-	}
-	if _, err = r.Read(hop.StealthBlind[:]); err != nil {
-		return nil, nil, err
-	}
-	if err = binary.Read(r, binary.BigEndian, &hop.Fee); err != nil {
+	rest = make([]byte, 1+MaxHops*PayloadSize)
+	rest[0] = 1
+	copy(rest[1:], blob[PayloadSize:])
+	if _, err = rand.Read(rest[1+(MaxHops-1)*PayloadSize:]); err != nil {
 		return nil, nil, err
 	}
+	return blob[:PayloadSize], rest, nil
+}
 
-	var k secp256k1.ModNScalar
-	if k.SetBytes((*[32]byte)(&hop.KernelBlind)) > 0 {
-		return nil, nil, errors.New("hop kernel blind overflowed")
+func peelV2(cipher *chacha20.Cipher, macKey, data []byte) (payload, rest []byte, err error) {
+	if len(data) != 1+macSize+blobSizeV2 {
+		return nil, nil, parseError("enc_payloads", ErrMalformed)
 	}
-	if k.SetBytes((*[32]byte)(&hop.StealthBlind)) > 0 {
-		return nil, nil, errors.New("hop stealth blind overflowed")
+	mac, blob := data[1:1+macSize], data[1+macSize:]
+	if !hmac.Equal(mac, computeMac(macKey, blob)) {
+		return nil, nil, ErrMacMismatch
 	}
 
-	hasOutput, err := r.ReadByte()
-	if err != nil {
-		return nil, nil, err
-	}
-	if hasOutput == 1 {
-		hop.Output = &wire.MwebOutput{}
-		if err = hop.Output.Deserialize(r); err != nil {
-			return nil, nil, err
-		}
-	}
+	buf := make([]byte, blobSizeV2+slotSizeV2)
+	copy(buf, blob)
+	cipher.XORKeyStream(buf, buf)
 
-	return hop, onion, nil
+	rest = append([]byte{2}, buf[PayloadSize:]...)
+	return buf[:PayloadSize], rest, nil
 }
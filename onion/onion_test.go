@@ -0,0 +1,171 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+func randKey() *mw.SecretKey {
+	k := &mw.SecretKey{}
+	rand.Read(k[:])
+	return k
+}
+
+func testHops(t testing.TB, n int) (hops []*Hop, keys []*ecdh.PrivateKey) {
+	for i := range n {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hop := &Hop{
+			PubKey:       key.PublicKey(),
+			KernelBlind:  mw.BlindingFactor(*randKey()),
+			StealthBlind: mw.BlindingFactor(*randKey()),
+			Fee:          uint64(i + 1),
+		}
+		if i == n-1 {
+			keychain := &mweb.Keychain{Scan: randKey(), Spend: randKey()}
+			senderKey := randKey()
+			output, blind, _ := mweb.CreateOutput(&mweb.Recipient{
+				Value: 1000, Address: keychain.Address(0)}, senderKey)
+			mweb.SignOutput(output, 1000, blind, senderKey)
+			hop.Output = output
+		}
+		hops = append(hops, hop)
+		keys = append(keys, key)
+	}
+	return
+}
+
+func testPeel(t *testing.T, onion *Onion, hops []*Hop, keys []*ecdh.PrivateKey) []int {
+	var sizes []int
+	for i, key := range keys {
+		sizes = append(sizes, len(onion.Payloads))
+		hop, next, err := onion.Peel(key)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if hop.KernelBlind != hops[i].KernelBlind ||
+			hop.StealthBlind != hops[i].StealthBlind ||
+			hop.Fee != hops[i].Fee ||
+			(hop.Output == nil) != (hops[i].Output == nil) {
+			t.Fatal("hop mismatch", i)
+		}
+		if hop.Output != nil && *hop.Output.Hash() != *hops[i].Output.Hash() {
+			t.Fatal("output mismatch")
+		}
+		onion = next
+	}
+	return sizes
+}
+
+func TestPeelV0(t *testing.T) {
+	hops, keys := testHops(t, 3)
+	onion, err := New(hops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := testPeel(t, onion, hops, keys)
+	if sizes[0] <= sizes[1] || sizes[1] <= sizes[2] {
+		t.Fatal(sizes)
+	}
+}
+
+func TestPeelV1(t *testing.T) {
+	for n := 1; n <= MaxHops; n++ {
+		hops, keys := testHops(t, n)
+		onion, err := NewV1(hops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range testPeel(t, onion, hops, keys) {
+			if size != 1+MaxHops*PayloadSize {
+				t.Fatal("onion size changed", size)
+			}
+		}
+	}
+
+	hops, _ := testHops(t, MaxHops+1)
+	if _, err := NewV1(hops); err == nil {
+		t.Fatal("expected too many hops")
+	}
+}
+
+func TestPeelV2(t *testing.T) {
+	for n := 1; n <= MaxHops; n++ {
+		hops, keys := testHops(t, n)
+		onion, err := NewV2(hops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, size := range testPeel(t, onion, hops, keys) {
+			if size != 1+macSize+blobSizeV2 {
+				t.Fatal("onion size changed", size)
+			}
+		}
+	}
+}
+
+func TestPeelV2Tampered(t *testing.T) {
+	hops, keys := testHops(t, 3)
+	onion, err := NewV2(hops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, onion, err = onion.Peel(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the last node's layer on the way to the second.
+	onion.Payloads[len(onion.Payloads)-1] ^= 1
+	if _, _, err = onion.Peel(keys[1]); err == nil {
+		t.Fatal("expected mac mismatch")
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	hops, keys := testHops(t, 2)
+	onion, err := NewV2(hops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := &wire.MwebInput{InputPubKey: randKey().PubKey()}
+	spendKey := randKey()
+	input.OutputPubKey = *spendKey.PubKey()
+	onion.Sign(input, spendKey)
+
+	_, peeled, err := onion.Peel(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []*Onion{onion, peeled} {
+		var buf bytes.Buffer
+		if err = o.Serialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		var o2 Onion
+		if err = o2.Deserialize(&buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(o2.sigMsg(), o.sigMsg()) ||
+			!bytes.Equal(o2.OwnerProof, o.OwnerProof) {
+			t.Fatal("onion mismatch")
+		}
+	}
+	if !onion.VerifySig() {
+		t.Fatal("owner proof invalid")
+	}
+
+	onion.OwnerProof = onion.OwnerProof[1:]
+	if err = onion.Serialize(io.Discard); err == nil {
+		t.Fatal("expected length error")
+	}
+}
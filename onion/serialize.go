@@ -0,0 +1,118 @@
+package onion
+
+import (
+	"io"
+
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// SerializeVersion is the version byte that starts the binary encoding.
+const SerializeVersion = 0
+
+// inputFeatureBit is set when the onion carries its input and owner
+// proof, which is only the case before the first node has peeled it.
+const inputFeatureBit = 0x1
+
+// Serialize writes the onion in a compact binary form:
+//
+//	version (1) || features (1) || [output_id (32) || output_commit (33) ||
+//	output_pk (33) || input_pk (33) || input_sig (64)] || ephemeral_xpub (32) ||
+//	enc_payloads (varbytes) || [owner_proof (64)]
+//
+// The bracketed fields are present if the input feature bit is set.
+func (onion *Onion) Serialize(w io.Writer) error {
+	var features byte
+	if onion.Input.OutputId != nil || onion.OwnerProof != nil {
+		if err := onion.CheckSizes(); err != nil {
+			return err
+		}
+		features |= inputFeatureBit
+	} else if len(onion.PubKey) != 32 {
+		return parseError("ephemeral_xpub", ErrLength)
+	}
+
+	if _, err := w.Write([]byte{SerializeVersion, features}); err != nil {
+		return err
+	}
+	if features&inputFeatureBit > 0 {
+		for _, b := range [][]byte{
+			onion.Input.OutputId,
+			onion.Input.Commitment,
+			onion.Input.OutputPubKey,
+			onion.Input.InputPubKey,
+			onion.Input.Signature,
+		} {
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.Write(onion.PubKey); err != nil {
+		return err
+	}
+	if err := wire.WriteVarBytes(w, 0, onion.Payloads); err != nil {
+		return err
+	}
+	if features&inputFeatureBit > 0 {
+		if _, err := w.Write(onion.OwnerProof); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deserialize reads an onion written by Serialize.
+func (onion *Onion) Deserialize(r io.Reader) error {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return parseError("version", err)
+	}
+	if header[0] != SerializeVersion {
+		return parseError("version", ErrVersion)
+	}
+	features := header[1]
+	if features&^inputFeatureBit != 0 {
+		return parseError("features", ErrMalformed)
+	}
+
+	*onion = Onion{}
+	read := func(field string, n int) (b []byte, err error) {
+		b = make([]byte, n)
+		if _, err = io.ReadFull(r, b); err != nil {
+			err = parseError(field, err)
+		}
+		return
+	}
+
+	var err error
+	if features&inputFeatureBit > 0 {
+		for _, f := range []struct {
+			name string
+			b    *hexBytes
+			n    int
+		}{
+			{"output_id", &onion.Input.OutputId, 32},
+			{"output_commit", &onion.Input.Commitment, 33},
+			{"output_pk", &onion.Input.OutputPubKey, 33},
+			{"input_pk", &onion.Input.InputPubKey, 33},
+			{"input_sig", &onion.Input.Signature, 64},
+		} {
+			if *f.b, err = read(f.name, f.n); err != nil {
+				return err
+			}
+		}
+	}
+	if onion.PubKey, err = read("ephemeral_xpub", 32); err != nil {
+		return err
+	}
+	onion.Payloads, err = wire.ReadVarBytes(r, 0, MaxPayloadsSize, "enc_payloads")
+	if err != nil {
+		return parseError("enc_payloads", err)
+	}
+	if features&inputFeatureBit > 0 {
+		if onion.OwnerProof, err = read("owner_proof", 64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+var update = flag.Bool("update", false, "regenerate testdata/vectors.json")
+
+const vectorsFile = "testdata/vectors.json"
+
+type (
+	vectorHop struct {
+		ServerKey    hexBytes `json:"server_key"`
+		ServerPubKey hexBytes `json:"server_pubkey"`
+		KernelBlind  hexBytes `json:"kernel_blind"`
+		StealthBlind hexBytes `json:"stealth_blind"`
+		Fee          uint64   `json:"fee"`
+		Output       hexBytes `json:"output,omitempty"`
+	}
+	vectorInput struct {
+		OutputId     hexBytes `json:"output_id"`
+		Commitment   hexBytes `json:"output_commit"`
+		OutputPubKey hexBytes `json:"output_pk"`
+		InputPubKey  hexBytes `json:"input_pk"`
+		Signature    hexBytes `json:"input_sig"`
+	}
+	vectorLayer struct {
+		Payload  hexBytes `json:"payload"`
+		Payloads hexBytes `json:"enc_payloads"`
+		PubKey   hexBytes `json:"ephemeral_xpub"`
+	}
+	vector struct {
+		Description string        `json:"description"`
+		Version     byte          `json:"version"`
+		Hops        []vectorHop   `json:"hops"`
+		Random      hexBytes      `json:"random"`
+		Input       vectorInput   `json:"input"`
+		SpendKey    hexBytes      `json:"spend_key"`
+		Onion       *Onion        `json:"onion"`
+		Layers      []vectorLayer `json:"layers"`
+	}
+)
+
+var vectorDescriptions = []string{
+	"Variable size onion. Random holds the ephemeral keys.",
+	"Fixed size onion. Random holds the ephemeral keys and then the " +
+		"initial padding. Each node appends fresh random bytes when " +
+		"peeling, so only the first (7-i)*1024 bytes of layer i's " +
+		"enc_payloads after the version byte are deterministic.",
+	"Fixed size onion with per-hop MACs. Random holds the ephemeral " +
+		"keys and then the padding in front of the filler.",
+}
+
+func (v *vector) hops() (hops []*Hop, keys []*ecdh.PrivateKey, err error) {
+	for _, vh := range v.Hops {
+		key, err := ecdh.X25519().NewPrivateKey(vh.ServerKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		hop := &Hop{PubKey: key.PublicKey(), Fee: vh.Fee}
+		copy(hop.KernelBlind[:], vh.KernelBlind)
+		copy(hop.StealthBlind[:], vh.StealthBlind)
+		if vh.Output != nil {
+			hop.Output = &wire.MwebOutput{}
+			if err = hop.Output.Deserialize(bytes.NewReader(vh.Output)); err != nil {
+				return nil, nil, err
+			}
+		}
+		hops = append(hops, hop)
+		keys = append(keys, key)
+	}
+	return
+}
+
+func (v *vector) input() *wire.MwebInput {
+	input := &wire.MwebInput{InputPubKey: &mw.PublicKey{}}
+	copy(input.OutputId[:], v.Input.OutputId)
+	copy(input.Commitment[:], v.Input.Commitment)
+	copy(input.OutputPubKey[:], v.Input.OutputPubKey)
+	copy(input.InputPubKey[:], v.Input.InputPubKey)
+	copy(input.Signature[:], v.Input.Signature)
+	return input
+}
+
+// build creates the vector's onion from its inputs, then peels it.
+func (v *vector) build() error {
+	hops, keys, err := v.hops()
+	if err != nil {
+		return err
+	}
+	onion, err := NewWithRand(bytes.NewReader(v.Random), v.Version, hops)
+	if err != nil {
+		return err
+	}
+	onion.Sign(v.input(), (*mw.SecretKey)(v.SpendKey))
+	v.Onion = onion
+
+	v.Layers = nil
+	for _, key := range keys {
+		hop, next, err := onion.Peel(key)
+		if err != nil {
+			return err
+		}
+		v.Layers = append(v.Layers, vectorLayer{
+			Payload:  hop.serialize(v.Version, next.PubKey),
+			Payloads: next.Payloads,
+			PubKey:   next.PubKey,
+		})
+		onion = next
+	}
+	return nil
+}
+
+func newVector(t *testing.T, ver byte) *vector {
+	hops, keys := testHops(t, 3)
+	v := &vector{Description: vectorDescriptions[ver], Version: ver}
+	for i, hop := range hops {
+		vh := vectorHop{
+			ServerKey:    keys[i].Bytes(),
+			ServerPubKey: hop.PubKey.Bytes(),
+			KernelBlind:  hop.KernelBlind[:],
+			StealthBlind: hop.StealthBlind[:],
+			Fee:          hop.Fee,
+		}
+		if hop.Output != nil {
+			var buf bytes.Buffer
+			hop.Output.Serialize(&buf)
+			vh.Output = buf.Bytes()
+		}
+		v.Hops = append(v.Hops, vh)
+	}
+
+	var random bytes.Buffer
+	if _, err := NewWithRand(io.TeeReader(rand.Reader, &random), ver, hops); err != nil {
+		t.Fatal(err)
+	}
+	v.Random = random.Bytes()
+
+	spendKey := randKey()
+	sig := make([]byte, 64)
+	rand.Read(sig)
+	v.Input = vectorInput{
+		OutputId:     randKey()[:],
+		Commitment:   mw.NewCommitment((*mw.BlindingFactor)(randKey()), 1000)[:],
+		OutputPubKey: spendKey.PubKey()[:],
+		InputPubKey:  randKey().PubKey()[:],
+		Signature:    sig,
+	}
+	v.SpendKey = spendKey[:]
+
+	if err := v.build(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVectors(t *testing.T) {
+	if *update {
+		var vectors []*vector
+		for ver := range byte(len(vectorDescriptions)) {
+			vectors = append(vectors, newVector(t, ver))
+		}
+		data, err := json.MarshalIndent(vectors, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(vectorsFile, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []*vector
+	if err = json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range vectors {
+		got := *want
+		if err = got.build(); err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(jsonBytes(t, got.Onion), jsonBytes(t, want.Onion)) {
+			t.Fatal("onion mismatch", i)
+		}
+		if !got.Onion.VerifySig() {
+			t.Fatal("owner proof invalid", i)
+		}
+		if len(got.Layers) != len(want.Layers) {
+			t.Fatal("layer count mismatch", i)
+		}
+		for j, layer := range got.Layers {
+			payloads, wantPayloads := layer.Payloads, want.Layers[j].Payloads
+			if got.Version == 1 {
+				n := 1 + (MaxHops-1-j)*PayloadSize
+				payloads, wantPayloads = payloads[:n], wantPayloads[:n]
+			}
+			if !bytes.Equal(layer.Payload, want.Layers[j].Payload) ||
+				!bytes.Equal(payloads, wantPayloads) ||
+				!bytes.Equal(layer.PubKey, want.Layers[j].PubKey) {
+				t.Fatal("layer mismatch", i, j)
+			}
+		}
+	}
+}
+
+func jsonBytes(t *testing.T, v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"encoding/gob"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+// sealPayload encrypts the payload to a neighbouring node as it is
+// being encoded. The stream cipher only hides the payload; it is the
+// MAC of the roundMessage carrying it that authenticates it. As that
+// needs the payload whole, each write is encrypted in place as it is
+// appended, rather than through a copy as cipher.StreamWriter would.
+func sealPayload(pubKey *ecdh.PublicKey, encode func(io.Writer) error) ([]byte, error) {
+	stream, err := onion.NewCipher(serverKey, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	w := &sealWriter{stream: stream}
+	if err = encode(w); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+type sealWriter struct {
+	stream cipher.Stream
+	buf    bytes.Buffer
+}
+
+func (w *sealWriter) Write(p []byte) (int, error) {
+	n, _ := w.buf.Write(p)
+	b := w.buf.Bytes()[w.buf.Len()-n:]
+	w.stream.XORKeyStream(b, b)
+	return n, nil
+}
+
+// openPayload decrypts a payload from a neighbouring node as it is read.
+// It doesn't check the payload's integrity, so the roundMessage must have
+// been verified first.
+// The result is an io.ByteReader so that gob doesn't read ahead of the
+// raw outputs and kernels that follow its values.
+func openPayload(pubKey *ecdh.PublicKey, data []byte) (*bufio.Reader, error) {
+	stream, err := onion.NewCipher(serverKey, pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(cipher.StreamReader{S: stream, R: bytes.NewReader(data)}), nil
+}
+
+func compareCommits(c1, c2 mw.Commitment) int {
+	return bytes.Compare(c1[:], c2[:])
+}
+
+func compareOutputs(o1, o2 *wire.MwebOutput) int {
+	return bytes.Compare(o1.Hash()[:], o2.Hash()[:])
+}
+
+func encodeOnions(w io.Writer, onions map[mw.Commitment]*onionEtc) error {
+	commits := slices.SortedFunc(maps.Keys(onions), compareCommits)
+	if err := gob.NewEncoder(w).Encode(commits); err != nil {
+		return err
+	}
+	for _, commit := range commits {
+		if err := onions[commit].Onion.Serialize(w); err != nil {
+			return err
+		}
+		if _, err := w.Write(onions[commit].StealthSum[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeOnions(r *bufio.Reader, max int) (map[mw.Commitment]*onionEtc, error) {
+	var commits []mw.Commitment
+	if err := gob.NewDecoder(r).Decode(&commits); err != nil {
+		return nil, err
+	}
+	if len(commits) > max {
+		return nil, errors.New("round exceeds weight limit")
+	}
+
+	onions := make(map[mw.Commitment]*onionEtc, len(commits))
+	for _, commit := range commits {
+		o := &onionEtc{Onion: &onion.Onion{}, StealthSum: &mw.PublicKey{}}
+		if err := o.Onion.Deserialize(r); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, o.StealthSum[:]); err != nil {
+			return nil, err
+		}
+		onions[commit] = o
+	}
+	return onions, nil
+}
+
+func encodeBackward(w io.Writer, commits []mw.Commitment,
+	outputs []*wire.MwebOutput, kernels []*wire.MwebKernel) error {
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(commits); err != nil {
+		return err
+	}
+	if err := enc.Encode(len(outputs)); err != nil {
+		return err
+	}
+	for _, output := range outputs {
+		if err := output.Serialize(w); err != nil {
+			return err
+		}
+	}
+	for _, kernel := range kernels {
+		if err := kernel.Serialize(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeBackward(r *bufio.Reader, maxOutputs, nKernels int) (
+	commits map[mw.Commitment]bool,
+	outputs []*wire.MwebOutput,
+	kernels []*wire.MwebKernel, err error) {
+
+	var (
+		dec        = gob.NewDecoder(r)
+		commitList []mw.Commitment
+		count      int
+	)
+	if err = dec.Decode(&commitList); err != nil {
+		return
+	}
+	if err = dec.Decode(&count); err != nil {
+		return
+	}
+	if count < 0 || count > maxOutputs {
+		err = errors.New("bad output count")
+		return
+	}
+
+	commits = make(map[mw.Commitment]bool, len(commitList))
+	for _, commit := range commitList {
+		commits[commit] = true
+	}
+
+	outputs = make([]*wire.MwebOutput, count)
+	for i := range outputs {
+		outputs[i] = &wire.MwebOutput{}
+		if err = outputs[i].Deserialize(r); err != nil {
+			return
+		}
+	}
+
+	kernels = make([]*wire.MwebKernel, nKernels)
+	for i := range kernels {
+		kernels[i] = &wire.MwebKernel{}
+		if err = kernels[i].Deserialize(r); err != nil {
+			return
+		}
+	}
+	return
+}
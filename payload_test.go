@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+func fakeOnions(n int) map[mw.Commitment]*onionEtc {
+	onions := make(map[mw.Commitment]*onionEtc, n)
+	for range n {
+		var commit mw.Commitment
+		rand.Read(commit[:])
+		o := &onionEtc{Onion: &onion.Onion{
+			Payloads: make([]byte, 512),
+			PubKey:   make([]byte, 32),
+		}, StealthSum: &mw.PublicKey{}}
+		rand.Read(o.Onion.Payloads)
+		onions[commit] = o
+	}
+	return onions
+}
+
+func TestOnionsPayload(t *testing.T) {
+	peerKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	onions := fakeOnions(100)
+
+	data, err := sealPayload(peerKey.PublicKey(), func(w io.Writer) error {
+		return encodeOnions(w, onions)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := openPayload(peerKey.PublicKey(), data)
+	if _, err = decodeOnions(r, 99); err == nil {
+		t.Fatal("expected capacity error")
+	}
+	r, _ = openPayload(peerKey.PublicKey(), data)
+	onions2, err := decodeOnions(r, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for commit, o := range onions {
+		if string(onions2[commit].Onion.Payloads) != string(o.Onion.Payloads) {
+			t.Fatal("payload mismatch")
+		}
+	}
+}
+
+func TestBackwardPayload(t *testing.T) {
+	peerKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	_, onionEtc := testOnion(t)
+	hop, _, err := onionEtc.Onion.Peel(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := hop.Output.Commitment
+	kernel := &wire.MwebKernel{Excess: commit}
+
+	data, err := sealPayload(peerKey.PublicKey(), func(w io.Writer) error {
+		return encodeBackward(w, []mw.Commitment{commit},
+			[]*wire.MwebOutput{hop.Output}, []*wire.MwebKernel{kernel})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := openPayload(peerKey.PublicKey(), data)
+	commits, outputs, kernels, err := decodeBackward(r, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commits[commit] || len(outputs) != 1 || len(kernels) != 1 ||
+		*outputs[0].Hash() != *hop.Output.Hash() ||
+		*kernels[0].Hash() != *kernel.Hash() {
+		t.Fatal("backward payload mismatch")
+	}
+}
+
+func BenchmarkOnionsPayload(b *testing.B) {
+	peerKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+
+	for _, n := range []int{1000, 10000, 100000} {
+		onions := fakeOnions(n)
+		b.Run(fmt.Sprint("onions=", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				data, err := sealPayload(peerKey.PublicKey(), func(w io.Writer) error {
+					return encodeOnions(w, onions)
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				r, _ := openPayload(peerKey.PublicKey(), data)
+				if _, err = decodeOnions(r, n); err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(len(data)))
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "onions/s")
+		})
+	}
+}
+
+func BenchmarkBackwardPayload(b *testing.B) {
+	peerKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	_, onionEtc := testOnion(b)
+	hop, _, _ := onionEtc.Onion.Peel(serverKey)
+	kernel := &wire.MwebKernel{Excess: hop.Output.Commitment}
+
+	// Each onion comes back as an output, along with a kernel per node.
+	kernels := []*wire.MwebKernel{kernel, kernel, kernel}
+
+	for _, n := range []int{1000, 10000, 100000} {
+		var (
+			commits []mw.Commitment
+			outputs []*wire.MwebOutput
+		)
+		for commit := range fakeOnions(n) {
+			commits = append(commits, commit)
+			outputs = append(outputs, hop.Output)
+		}
+		b.Run(fmt.Sprint("onions=", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				data, err := sealPayload(peerKey.PublicKey(), func(w io.Writer) error {
+					return encodeBackward(w, commits, outputs, kernels)
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				r, _ := openPayload(peerKey.PublicKey(), data)
+				if _, _, _, err = decodeBackward(r, n, len(kernels)); err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(len(data)))
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "onions/s")
+		})
+	}
+}
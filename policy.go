@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+)
+
+// Policy decides what the node mixes. Admit is consulted by Swap for an
+// onion that passed validation, with the RPC context of the submission.
+type Policy interface {
+	Admit(ctx context.Context, onion *onion.Onion) error
+}
+
+// RoundPolicy is a Policy that is also consulted by performSwap for each
+// queued onion when a round starts, as what it checks can change while
+// the onion is queued. Onions it refuses stay queued until they expire.
+type RoundPolicy interface {
+	Policy
+	Include(q *queuedOnion) error
+}
+
+func policyError(format string, a ...any) error {
+	return &admissionError{-32005, "refused by policy: " + fmt.Sprintf(format, a...)}
+}
+
+// policies applies each of its policies in turn, so that all of them
+// must allow an onion. Without any, everything is allowed.
+type policies []Policy
+
+func (ps policies) Admit(ctx context.Context, onion *onion.Onion) error {
+	for _, p := range ps {
+		if err := p.Admit(ctx, onion); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ps policies) Include(q *queuedOnion) error {
+	for _, p := range ps {
+		if rp, ok := p.(RoundPolicy); ok {
+			if err := rp.Include(q); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// policyConfig is the file given with -policy.
+type policyConfig struct {
+	DenyOutputIds    []string `json:"deny_output_ids"`
+	MaxOnionsPerIP   int      `json:"max_onions_per_ip"`
+	MinConfirmations int      `json:"min_confirmations"`
+}
+
+// loadPolicy builds the built-in policies from the config file, if any,
+// and from the -min-conf flag. If both set a number of confirmations,
+// the larger applies.
+func loadPolicy(path string) (policies, error) {
+	var cfg policyConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var ps policies
+	if len(cfg.DenyOutputIds) > 0 {
+		deny := denyPolicy{}
+		for _, s := range cfg.DenyOutputIds {
+			outputId, err := hex.DecodeString(s)
+			if err != nil || len(outputId) != chainhash.HashSize {
+				return nil, fmt.Errorf("bad output id %q", s)
+			}
+			deny[chainhash.Hash(outputId)] = true
+		}
+		ps = append(ps, deny)
+	}
+	if cfg.MaxOnionsPerIP > 0 {
+		ps = append(ps, &perIPPolicy{
+			max:    cfg.MaxOnionsPerIP,
+			onions: map[string]map[mw.Commitment]bool{},
+		})
+	}
+	if n := max(cfg.MinConfirmations, *minCoinConfs); n > 0 {
+		ps = append(ps, coinAgePolicy(n))
+	}
+	return ps, nil
+}
+
+// denyPolicy refuses to mix the listed coins.
+type denyPolicy map[chainhash.Hash]bool
+
+func (p denyPolicy) Admit(ctx context.Context, onion *onion.Onion) error {
+	return p.check(onion)
+}
+
+func (p denyPolicy) Include(q *queuedOnion) error {
+	return p.check(q.Onion)
+}
+
+func (p denyPolicy) check(onion *onion.Onion) error {
+	if p[chainhash.Hash(onion.Input.OutputId)] {
+		return policyError("output id is denied")
+	}
+	return nil
+}
+
+// perIPPolicy bounds the onions queued from one IP address, or one /64
+// for IPv6. It only knows about submissions since startup, and forgets
+// those that have left the queue when the address submits again.
+type perIPPolicy struct {
+	mu     sync.Mutex
+	max    int
+	onions map[string]map[mw.Commitment]bool
+}
+
+func (p *perIPPolicy) Admit(ctx context.Context, onion *onion.Onion) error {
+	addr := rpc.PeerInfoFromContext(ctx).RemoteAddr
+	if addr == "" {
+		return nil
+	}
+	return p.admit(clientKey(addr), mw.Commitment(onion.Input.Commitment))
+}
+
+func (p *perIPPolicy) admit(host string, commit mw.Commitment) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	commits := p.onions[host]
+	if commits == nil {
+		commits = map[mw.Commitment]bool{}
+		p.onions[host] = commits
+	}
+	if !commits[commit] && len(commits) >= p.max {
+		for c := range commits {
+			if found, err := hasOnion(db, c[:]); err == nil && !found {
+				delete(commits, c)
+			}
+		}
+		if len(commits) >= p.max {
+			return policyError("too many onions from %s", host)
+		}
+	}
+	commits[commit] = true
+	return nil
+}
+
+// coinAgePolicy requires coins to have some number of confirmations.
+// They are checked again when a round starts, in case a reorg has moved
+// the coin to a later block.
+type coinAgePolicy int
+
+func (p coinAgePolicy) Admit(ctx context.Context, onion *onion.Onion) error {
+	return p.check(onion)
+}
+
+func (p coinAgePolicy) Include(q *queuedOnion) error {
+	return p.check(q.Onion)
+}
+
+func (p coinAgePolicy) check(onion *onion.Onion) error {
+	height, err := coinHeight(db, (*chainhash.Hash)(onion.Input.OutputId))
+	if err != nil {
+		return err
+	}
+	st, err := cachedSyncState()
+	if err != nil {
+		return err
+	}
+	if int64(st.HeaderHeight)-int64(height)+1 < int64(p) {
+		return errCoinTooYoung
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+	"github.com/ltcmweb/neutrino/mwebdb"
+)
+
+func TestLoadPolicy(t *testing.T) {
+	q := &queuedOnion{Onion: testSignedOnion(t)}
+	path := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(path, []byte(`{"deny_output_ids": ["`+
+		hex.EncodeToString(q.Input.OutputId)+`"]}`), 0600)
+
+	policy, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Admit(context.Background(), q.Onion) == nil || policy.Include(q) == nil {
+		t.Fatal("denied onion accepted")
+	}
+	other := testSignedOnion(t)
+	if policy.Admit(context.Background(), other) != nil {
+		t.Fatal("onion refused")
+	}
+
+	os.WriteFile(path, []byte(`{"deny_output_ids": ["00"]}`), 0600)
+	if _, err = loadPolicy(path); err == nil {
+		t.Fatal("expected bad output id")
+	}
+}
+
+func TestLoadPolicyMinConfs(t *testing.T) {
+	defer func(n int) { *minCoinConfs = n }(*minCoinConfs)
+	path := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(path, []byte(`{"min_confirmations": 6}`), 0600)
+
+	for _, flag := range []int{0, 3, 10} {
+		*minCoinConfs = flag
+		policy, err := loadPolicy(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(policy) != 1 || policy[0] != coinAgePolicy(max(flag, 6)) {
+			t.Fatal("wrong coin age for -min-conf", flag, policy)
+		}
+	}
+}
+
+func TestPerIPPolicy(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	p := &perIPPolicy{max: 2, onions: map[string]map[mw.Commitment]bool{}}
+
+	var queued []*queuedOnion
+	for range 2 {
+		q := &queuedOnion{Onion: testSignedOnion(t), Submitted: time.Now()}
+		if err := p.admit("1.2.3.4", mw.Commitment(q.Input.Commitment)); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveOnion(db, q); err != nil {
+			t.Fatal(err)
+		}
+		queued = append(queued, q)
+	}
+
+	commit := mw.Commitment(testSignedOnion(t).Input.Commitment)
+	if p.admit("1.2.3.4", commit) == nil {
+		t.Fatal("per-IP limit not applied")
+	}
+	if p.admit("5.6.7.8", commit) != nil {
+		t.Fatal("limit applied to another IP")
+	}
+	if p.admit("1.2.3.4", mw.Commitment(queued[0].Input.Commitment)) != nil {
+		t.Fatal("resubmission refused")
+	}
+
+	if err := deleteOnion(db, queued[0].Onion); err != nil {
+		t.Fatal(err)
+	}
+	if p.admit("1.2.3.4", commit) != nil {
+		t.Fatal("mixed onion still counted")
+	}
+}
+
+func TestCoinAgePolicy(t *testing.T) {
+	useTestDB(t)
+	store, err := mwebdb.NewCoinStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, o := testOnion(t)
+	hop, _, err := o.Onion.Peel(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &queuedOnion{Onion: testSignedOnion(t)}
+	q.Input.OutputId = hop.Output.Hash()[:]
+	err = store.PutCoins([]*wire.MwebNetUtxo{{
+		Height: 100, Output: hop.Output, OutputId: hop.Output.Hash()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { syncCache.st = nil }()
+	syncCache.st, syncCache.at = &syncState{HeaderHeight: 102}, time.Now()
+	p := policies{coinAgePolicy(3)}
+	if p.Admit(context.Background(), q.Onion) != nil || p.Include(q) != nil {
+		t.Fatal("coin with enough confirmations refused")
+	}
+
+	// A reorg has moved the coin to a later block since it was queued.
+	err = store.PutCoins([]*wire.MwebNetUtxo{{
+		Height: 101, Output: hop.Output, OutputId: hop.Output.Hash()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Include(q) != errCoinTooYoung {
+		t.Fatal("coin with too few confirmations included")
+	}
+}
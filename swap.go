@@ -3,14 +3,17 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
-	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"maps"
-	"math/big"
+	"runtime/debug"
 	"slices"
+	"time"
 
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ltcmweb/coinswapd/config"
 	"github.com/ltcmweb/coinswapd/onion"
 	"github.com/ltcmweb/ltcd/ltcutil/mweb"
 	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
@@ -22,128 +25,326 @@ type onionEtc struct {
 	StealthSum *mw.PublicKey
 }
 
+// round holds the state of the swap this node is taking part in. The
+// node list is the one agreed for the round, so that neither a refresh
+// of the alive nodes nor another node's view can change our position.
+type round struct {
+	id        []byte
+	phase     roundPhase
+	nodes     []config.Node
+	nodeIndex int
+	onions    map[mw.Commitment]*onionEtc
+	hops      map[mw.Commitment]*onion.Hop
+	submitted map[mw.Commitment]time.Time
+	diag      roundDiag
+}
+
+// roundPhase tells which message a node expects next in a round. Each
+// is accepted once, so that neither replays nor messages out of turn
+// can disturb the round.
+type roundPhase int
+
+const (
+	phaseForward roundPhase = iota
+	phaseBackward
+	phaseDone
+)
+
+func newRound(a *agreedRound) *round {
+	return &round{
+		id:        a.id,
+		nodes:     a.nodes,
+		nodeIndex: a.nodeIndex,
+		onions:    map[mw.Commitment]*onionEtc{},
+		submitted: map[mw.Commitment]time.Time{},
+		diag: roundDiag{
+			Started: time.Now(),
+			Round:   hex.EncodeToString(a.id),
+			Nodes:   len(a.nodes),
+		},
+	}
+}
+
+func (r *round) lastNode() bool {
+	return r.nodeIndex == len(r.nodes)-1
+}
+
 func (s *swapService) performSwap() error {
+	a := s.prepareRound()
+	if a == nil {
+		return nil
+	}
+
+	s.roundMu.Lock()
+	defer s.roundMu.Unlock()
+
+	s.recoveries = 0
+	return s.startRound(a)
+}
+
+// prepareRound waits for the chain to sync and agrees on the node set,
+// if we are the entry node. It doesn't hold roundMu, so that a previous
+// round can still be served meanwhile.
+func (s *swapService) prepareRound() *agreedRound {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	nodes, nodeIndex := s.nodes, s.nodeIndex
+	s.mu.Unlock()
 
-	if s.nodeIndex != 0 {
+	if nodeIndex != 0 {
+		return nil
+	}
+	if !waitForSync(syncTimeout) {
+		fmt.Println("Chain not synced, skipping swap")
 		return nil
 	}
-	fmt.Println("Performing swap")
 
+	a, err := agreeRound(nodes)
+	if err != nil {
+		fmt.Println("Skipping swap:", err)
+		return nil
+	}
+	return a
+}
+
+// syncTimeout is how long a round waits for the chain to sync
+// before it is skipped.
+const syncTimeout = 30 * time.Minute
+
+// roundExpiryMargin allows for the time a round takes, so that onions
+// expiring while it runs are left out of it.
+const roundExpiryMargin = 10 * time.Minute
+
+// pruneOnions deletes queued onions that have expired. Onions we can't
+// read with our key are left alone, as the key may just be misconfigured.
+func pruneOnions() error {
+	n, err := countSealedWithOtherKey(db)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		fmt.Println("Keeping", n, "onions sealed with another server key,",
+			"which count towards -max-queue")
+	}
 	onions, err := loadOnions(db)
 	if err != nil {
 		return err
 	}
+	now := time.Now()
+	for _, q := range onions {
+		if q.expired(now) {
+			if err = deleteOnion(db, q.Onion); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	s.onions = map[mw.Commitment]*onionEtc{}
-	for _, onion := range onions {
-		if err = validateOnion(onion); err != nil {
-			if err = deleteOnion(db, onion); err != nil {
+func (s *swapService) startRound(a *agreedRound) error {
+	r := newRound(a)
+	fmt.Println("Performing swap", r.diag.Round, "with", len(r.nodes), "nodes")
+
+	onions, err := loadOnions(db)
+	if err != nil {
+		return err
+	}
+
+	s.round = r
+	r.diag.Onions = len(onions)
+	deadline := time.Now().Add(roundExpiryMargin)
+	for _, q := range onions {
+		if q.expired(deadline) {
+			r.diag.Expired++
+			if err = deleteOnion(db, q.Onion); err != nil {
+				return err
+			}
+			continue
+		}
+		if s.policy.Include(q) != nil {
+			r.diag.Refused++
+			continue
+		}
+		err = validateOnion(q.Onion)
+		if errors.Is(err, errCoinLookup) {
+			return r.diag.fail("validate", err)
+		}
+		if isTransient(err) {
+			// Leave it queued while the coin may still come back
+			// after a reorg.
+			r.diag.Transient++
+			continue
+		}
+		if err != nil {
+			r.diag.Dropped++
+			if err = deleteOnion(db, q.Onion); err != nil {
 				return err
 			}
 			continue
 		}
 
-		input, _ := inputFromOnion(onion)
-		s.onions[input.Commitment] = &onionEtc{
-			Onion:      onion,
+		input, _ := inputFromOnion(q.Onion)
+		r.onions[input.Commitment] = &onionEtc{
+			Onion:      q.Onion,
 			StealthSum: input.OutputPubKey.Sub(input.InputPubKey),
 		}
+		r.submitted[input.Commitment] = q.Submitted
+	}
+
+	// The oldest onions go first, so that none wait until they expire.
+	if n := len(r.onions) - roundCapacity(len(r.nodes), *maxWeight); n > 0 {
+		fmt.Println("Deferring", n, "onions to the next round")
+		r.diag.Deferred = n
+		commits := slices.SortedFunc(maps.Keys(r.onions), func(c1, c2 mw.Commitment) int {
+			return r.submitted[c1].Compare(r.submitted[c2])
+		})
+		for _, commit := range commits[len(commits)-n:] {
+			delete(r.onions, commit)
+		}
 	}
 
 	return s.forward()
 }
 
-func (s *swapService) peelOnions() (
-	onions map[mw.Commitment]*onionEtc,
-	outputs []*wire.MwebOutput) {
+// errPeelPanic is recorded for an onion whose peeling panicked.
+var errPeelPanic = errors.New("peeling panicked")
+
+type peeled struct {
+	commit     mw.Commitment
+	hop        *onion.Hop
+	onion      *onion.Onion
+	commit2    *mw.Commitment
+	stealthSum *mw.PublicKey
+	err        error
+	ok         bool
+}
 
-	onions = map[mw.Commitment]*onionEtc{}
+// peelOnion does the expensive work for a single onion (ECDH, decryption,
+// commitment arithmetic and, at the last node, the range proof) so that
+// it can be spread over all cores.
+func (r *round) peelOnion(p *peeled) {
+	hop, onion, err := r.onions[p.commit].Onion.Peel(serverKey)
+	if err != nil {
+		p.err = err
+		return
+	}
+	p.hop, p.onion = hop, onion
 
-	for commit, o := range s.onions {
-		hop, onion, err := o.Onion.Peel(serverKey)
-		if err != nil {
-			delete(s.onions, commit)
-			continue
-		}
+	p.commit2 = p.commit.Add(mw.NewCommitment(&hop.KernelBlind, 0)).
+		Sub(mw.NewCommitment(&mw.BlindingFactor{}, hop.Fee))
 
-		commit2 := commit.Add(mw.NewCommitment(&hop.KernelBlind, 0)).
-			Sub(mw.NewCommitment(&mw.BlindingFactor{}, hop.Fee))
+	stealthBlind := mw.SecretKey(hop.StealthBlind)
+	p.stealthSum = r.onions[p.commit].StealthSum.Add(stealthBlind.PubKey())
+
+	if r.lastNode() != (hop.Output != nil) {
+		return
+	}
 
-		stealthBlind := mw.SecretKey(hop.StealthBlind)
-		stealthSum := o.StealthSum.Add(stealthBlind.PubKey())
+	if hop.Output != nil {
+		var msg bytes.Buffer
+		hop.Output.Message.Serialize(&msg)
 
-		if _, ok := onions[*commit2]; ok {
-			delete(s.onions, commit)
-			continue
+		if *p.commit2 != hop.Output.Commitment ||
+			*p.stealthSum != hop.Output.SenderPubKey ||
+			hop.Output.RangeProof == nil ||
+			!hop.Output.RangeProof.Verify(*p.commit2, msg.Bytes()) ||
+			!hop.Output.VerifySig() {
+			return
 		}
+	}
 
-		lastNode := s.nodeIndex == len(s.nodes)-1
-		hasOutput := hop.Output != nil
+	p.ok = true
+}
 
-		if lastNode != hasOutput {
-			delete(s.onions, commit)
-			continue
-		}
+// senderFault tells whether peeling failed because of how the sender
+// built the onion.
+func senderFault(err error) bool {
+	var parseErr *onion.ParseError
+	return errors.As(err, &parseErr) || errors.Is(err, onion.ErrMacMismatch)
+}
 
-		if hasOutput {
-			var msg bytes.Buffer
-			hop.Output.Message.Serialize(&msg)
+func (s *swapService) peelOnions() (
+	onions map[mw.Commitment]*onionEtc,
+	outputs []*wire.MwebOutput) {
 
-			if *commit2 != hop.Output.Commitment ||
-				*stealthSum != hop.Output.SenderPubKey ||
-				hop.Output.RangeProof == nil ||
-				!hop.Output.RangeProof.Verify(*commit2, msg.Bytes()) ||
-				!hop.Output.VerifySig() {
+	r := s.round
+	onions = map[mw.Commitment]*onionEtc{}
 
-				delete(s.onions, commit)
-				continue
+	var ps []*peeled
+	for commit := range r.onions {
+		ps = append(ps, &peeled{commit: commit})
+	}
+	parallelFor(len(ps), func(i int) {
+		defer func() {
+			if v := recover(); v != nil {
+				fmt.Printf("peelOnion: panic: %v\n%s", v, debug.Stack())
+				ps[i].err = fmt.Errorf("%w: %v", errPeelPanic, v)
 			}
+		}()
+		r.peelOnion(ps[i])
+	})
 
-			outputs = append(outputs, hop.Output)
+	r.hops = map[mw.Commitment]*onion.Hop{}
+	for _, p := range ps {
+		switch {
+		case errors.Is(p.err, onion.ErrMacMismatch):
+			r.diag.BadMacs++
+		case errors.Is(p.err, errPeelPanic):
+			r.diag.Panics++
 		}
-
-		onions[*commit2] = &onionEtc{onion, stealthSum}
+		if !p.ok {
+			// An onion that is malformed for us will never mix, so
+			// the entry node deletes it. Anything else may depend on
+			// this round, so it stays queued.
+			if r.nodeIndex == 0 && senderFault(p.err) {
+				if err := deleteOnion(db, r.onions[p.commit].Onion); err != nil {
+					fmt.Println("deleteOnion:", err)
+				}
+			}
+			delete(r.onions, p.commit)
+			continue
+		}
+		if _, ok := onions[*p.commit2]; ok {
+			delete(r.onions, p.commit)
+			continue
+		}
+		if p.hop.Output != nil {
+			outputs = append(outputs, p.hop.Output)
+		}
+		r.hops[p.commit] = p.hop
+		onions[*p.commit2] = &onionEtc{p.onion, p.stealthSum}
 	}
 
 	return
 }
 
 func (s *swapService) forward() error {
+	r := s.round
 	onions, outputs := s.peelOnions()
 
-	if s.nodeIndex == len(s.nodes)-1 {
+	if r.lastNode() {
 		return s.backward(outputs, nil)
 	}
 
-	commits := slices.SortedFunc(maps.Keys(onions), func(c1, c2 mw.Commitment) int {
-		a := new(big.Int).SetBytes(c1[:])
-		b := new(big.Int).SetBytes(c2[:])
-		return a.Cmp(b)
+	node := r.nodes[r.nodeIndex+1]
+	data, err := sealPayload(node.PubKey(), func(w io.Writer) error {
+		return encodeOnions(w, onions)
 	})
-
-	var data bytes.Buffer
-	enc := gob.NewEncoder(&data)
-	enc.Encode(commits)
-	for _, commit := range commits {
-		enc.Encode(onions[commit])
+	if err != nil {
+		return err
 	}
 
-	node := s.nodes[s.nodeIndex+1]
-	cipher, err := onion.NewCipher(serverKey, node.PubKey())
+	m, err := newRoundMessage(forwardTag, node, r.id, data)
 	if err != nil {
 		return err
 	}
-	cipher.XORKeyStream(data.Bytes(), data.Bytes())
-
 	client, err := rpc.Dial(node.Url)
 	if err != nil {
 		return err
 	}
 
+	r.phase = phaseBackward
 	go func() {
-		err := client.Call(nil, "swap_forward", data.Bytes())
+		err := client.Call(nil, "swap_forward", m)
 		if err != nil {
 			fmt.Println("swap_forward:", err)
 		}
@@ -152,36 +353,39 @@ func (s *swapService) forward() error {
 	return nil
 }
 
-func (s *swapService) Forward(data []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// Forward starts our part of the round we agreed to. The current round
+// is only replaced once the message has been authenticated and decoded.
+func (s *swapService) Forward(m *roundMessage) error {
+	s.roundMu.Lock()
+	defer s.roundMu.Unlock()
 
-	if s.nodeIndex == 0 {
-		return nil
+	if s.round != nil && bytes.Equal(s.round.id, m.Round) {
+		return errors.New("round already started")
 	}
+	a := s.agreedFor(m.Round)
+	if a == nil {
+		return errors.New("no agreed round")
+	}
+	r := newRound(a)
 
-	node := s.nodes[s.nodeIndex-1]
-	cipher, err := onion.NewCipher(serverKey, node.PubKey())
+	node := r.nodes[r.nodeIndex-1]
+	if err := m.check(forwardTag, node); err != nil {
+		return err
+	}
+	pr, err := openPayload(node.PubKey(), m.Data)
 	if err != nil {
 		return err
 	}
-	cipher.XORKeyStream(data, data)
-
-	var commits []mw.Commitment
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	if err := dec.Decode(&commits); err != nil {
+	r.onions, err = decodeOnions(pr, roundCapacity(len(r.nodes), maxMwebWeight))
+	if err != nil {
 		return err
 	}
+	r.diag.Onions = len(r.onions)
 
-	s.onions = map[mw.Commitment]*onionEtc{}
-	for _, commit := range commits {
-		var onion *onionEtc
-		if err := dec.Decode(&onion); err != nil {
-			return err
-		}
-		s.onions[commit] = onion
+	if !s.useAgreed(a) {
+		return errors.New("round superseded")
 	}
-
+	s.round = r
 	return s.forward()
 }
 
@@ -194,17 +398,19 @@ func (s *swapService) backward(
 		stealthBlind = &mw.BlindingFactor{}
 		senderKey    = &mw.SecretKey{}
 		nodeFee      uint64
+		r            = s.round
 	)
 
-	for _, o := range s.onions {
-		hop, _, _ := o.Onion.Peel(serverKey)
+	r.phase = phaseDone
+	for commit := range r.onions {
+		hop := r.hops[commit]
 		kernelBlind = kernelBlind.Add(&hop.KernelBlind)
 		stealthBlind = stealthBlind.Add(&hop.StealthBlind)
 		nodeFee += hop.Fee
 	}
 
-	nOutputs := len(outputs) + s.nodeIndex + 1
-	nNodes := uint64(len(s.nodes))
+	nOutputs := len(outputs) + r.nodeIndex + 1
+	nNodes := uint64(len(r.nodes))
 	fee := uint64(nOutputs) * mweb.StandardOutputWeight * mweb.BaseMwebFee
 	fee = (fee + nNodes - 1) / nNodes
 	fee += mweb.KernelWithStealthWeight * mweb.BaseMwebFee
@@ -227,41 +433,31 @@ func (s *swapService) backward(
 	kernels = append(kernels, mweb.CreateKernel(
 		kernelBlind, stealthBlind, &fee, nil, nil, nil))
 
-	slices.SortFunc(outputs, func(o1, o2 *wire.MwebOutput) int {
-		a := new(big.Int).SetBytes(o1.Hash()[:])
-		b := new(big.Int).SetBytes(o2.Hash()[:])
-		return a.Cmp(b)
-	})
+	slices.SortFunc(outputs, compareOutputs)
 
-	if s.nodeIndex == 0 {
+	if r.nodeIndex == 0 {
 		return s.finalize(outputs, kernels)
 	}
 
-	var data bytes.Buffer
-	enc := gob.NewEncoder(&data)
-	enc.Encode(slices.Collect(maps.Keys(s.onions)))
-	enc.Encode(len(outputs))
-	for _, output := range outputs {
-		output.Serialize(&data)
-	}
-	for _, kernel := range kernels {
-		kernel.Serialize(&data)
+	node := r.nodes[r.nodeIndex-1]
+	data, err := sealPayload(node.PubKey(), func(w io.Writer) error {
+		return encodeBackward(w, slices.Collect(maps.Keys(r.onions)), outputs, kernels)
+	})
+	if err != nil {
+		return err
 	}
 
-	node := s.nodes[s.nodeIndex-1]
-	cipher, err := onion.NewCipher(serverKey, node.PubKey())
+	m, err := newRoundMessage(backwardTag, node, r.id, data)
 	if err != nil {
 		return err
 	}
-	cipher.XORKeyStream(data.Bytes(), data.Bytes())
-
 	client, err := rpc.Dial(node.Url)
 	if err != nil {
 		return err
 	}
 
 	go func() {
-		err := client.Call(nil, "swap_backward", data.Bytes())
+		err := client.Call(nil, "swap_backward", m)
 		if err != nil {
 			fmt.Println("swap_backward:", err)
 		}
@@ -270,47 +466,45 @@ func (s *swapService) backward(
 	return nil
 }
 
-func (s *swapService) Backward(data []byte) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *swapService) Backward(m *roundMessage) error {
+	s.roundMu.Lock()
+	defer s.roundMu.Unlock()
+
+	r := s.round
+	switch {
+	case r == nil:
+		return errors.New("no round in progress")
+	case !bytes.Equal(r.id, m.Round):
+		return errors.New("not the current round")
+	case r.phase != phaseBackward:
+		return errors.New("unexpected backward message")
+	}
 
-	if s.nodeIndex == len(s.nodes)-1 {
-		return nil
+	node := r.nodes[r.nodeIndex+1]
+	if err := m.check(backwardTag, node); err != nil {
+		return err
 	}
+	r.phase = phaseDone
 
-	node := s.nodes[s.nodeIndex+1]
-	cipher, err := onion.NewCipher(serverKey, node.PubKey())
+	pr, err := openPayload(node.PubKey(), m.Data)
 	if err != nil {
 		return err
 	}
-	cipher.XORKeyStream(data, data)
+	commits, outputs, kernels, err := decodeBackward(pr,
+		len(r.onions)+len(r.nodes), len(r.nodes)-r.nodeIndex-1)
+	if err != nil {
+		return err
+	}
+	if len(outputs) == 0 || len(kernels) == 0 {
+		return errors.New("missing outputs or kernels")
+	}
 
 	var (
-		r       = bytes.NewReader(data)
-		dec     = gob.NewDecoder(r)
-		count   int
-		commits []mw.Commitment
-		outputs []*wire.MwebOutput
-		kernels []*wire.MwebKernel
-
 		commitSum, kernelExcess   *mw.Commitment
 		stealthSum, stealthExcess *mw.PublicKey
 	)
 
-	if err := dec.Decode(&commits); err != nil {
-		return err
-	}
-	if err := dec.Decode(&count); err != nil {
-		return err
-	}
-
-	for ; count > 0; count-- {
-		output := &wire.MwebOutput{}
-		if err := output.Deserialize(r); err != nil {
-			return err
-		}
-		outputs = append(outputs, output)
-
+	for _, output := range outputs {
 		if commitSum == nil {
 			commitSum = &output.Commitment
 			stealthSum = &output.SenderPubKey
@@ -320,13 +514,7 @@ func (s *swapService) Backward(data []byte) error {
 		}
 	}
 
-	for i := s.nodeIndex + 1; i < len(s.nodes); i++ {
-		kernel := &wire.MwebKernel{}
-		if err := kernel.Deserialize(r); err != nil {
-			return err
-		}
-		kernels = append(kernels, kernel)
-
+	for _, kernel := range kernels {
 		if kernelExcess == nil {
 			kernelExcess = &kernel.Excess
 			stealthExcess = &kernel.StealthExcess
@@ -337,18 +525,18 @@ func (s *swapService) Backward(data []byte) error {
 		kernelExcess = kernelExcess.Sub(mw.NewCommitment(&mw.BlindingFactor{}, kernel.Fee))
 	}
 
-	for commit, o := range s.onions {
-		hop, _, _ := o.Onion.Peel(serverKey)
+	for commit, o := range r.onions {
+		hop := r.hops[commit]
 
 		commit2 := commit.Add(mw.NewCommitment(&hop.KernelBlind, 0)).
 			Sub(mw.NewCommitment(&mw.BlindingFactor{}, hop.Fee))
 
-		if slices.Contains(commits, *commit2) {
+		if commits[*commit2] {
 			commitSum = commitSum.Sub(commit2)
 			stealthBlind := mw.SecretKey(hop.StealthBlind)
 			stealthSum = stealthSum.Sub(o.StealthSum.Add(stealthBlind.PubKey()))
 		} else {
-			delete(s.onions, commit)
+			delete(r.onions, commit)
 		}
 	}
 
@@ -366,18 +554,35 @@ func (s *swapService) finalize(
 	outputs []*wire.MwebOutput,
 	kernels []*wire.MwebKernel) error {
 
+	r := s.round
 	txBody := &wire.MwebTxBody{
 		Outputs: outputs,
 		Kernels: kernels,
 	}
-	for _, o := range s.onions {
+	for _, o := range r.onions {
 		input, _ := inputFromOnion(o.Onion)
 		txBody.Inputs = append(txBody.Inputs, input)
 	}
 	txBody.Sort()
 
-	return cs.SendTransaction(&wire.MsgTx{
-		Version: 2,
-		Mweb:    &wire.MwebTx{TxBody: txBody},
-	})
+	r.diag.Inputs = len(txBody.Inputs)
+	r.diag.Outputs = len(txBody.Outputs)
+	r.diag.Kernels = len(txBody.Kernels)
+	r.diag.Weight = mwebTxWeight(txBody)
+
+	tx := &wire.MwebTx{TxBody: txBody}
+	if err := validateTx(tx); err != nil {
+		return r.diag.fail("validate", err)
+	}
+
+	spent, err := spentInputs(txBody)
+	if err != nil {
+		return err
+	}
+	if len(spent) > 0 {
+		s.startRecovery(spent)
+		return r.diag.fail("finalize", fmt.Errorf("%d inputs already spent", len(spent)))
+	}
+
+	return s.broadcast(&wire.MsgTx{Version: 2, Mweb: tx})
 }
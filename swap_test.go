@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"maps"
+	"runtime"
+	"testing"
+
+	"github.com/ltcmweb/coinswapd/config"
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+)
+
+func init() {
+	serverKey, _ = ecdh.X25519().GenerateKey(rand.Reader)
+	_, identityKey, _ = ed25519.GenerateKey(rand.Reader)
+}
+
+// testOnion creates a single hop onion for serverKey, along with
+// the input commitment and stealth sum that it spends.
+func testOnion(tb testing.TB) (mw.Commitment, *onionEtc) {
+	const value, fee = 100000, 1000
+
+	keychain := &mweb.Keychain{Scan: randSecretKey(), Spend: randSecretKey()}
+	senderKey := randSecretKey()
+	output, blind, _ := mweb.CreateOutput(&mweb.Recipient{
+		Value: value, Address: keychain.Address(0)}, senderKey)
+	mweb.SignOutput(output, value, blind, senderKey)
+
+	inputBlind := (*mw.BlindingFactor)(randSecretKey())
+	inputKey, outputKey := randSecretKey(), randSecretKey()
+	hop := &onion.Hop{
+		PubKey:       serverKey.PublicKey(),
+		KernelBlind:  *mw.BlindSwitch(blind, value).Sub(inputBlind),
+		StealthBlind: mw.BlindingFactor(*senderKey.Sub(outputKey).Add(inputKey)),
+		Fee:          fee,
+		Output:       output,
+	}
+	o, err := onion.New([]*onion.Hop{hop})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return *mw.NewCommitment(inputBlind, value+fee), &onionEtc{
+		Onion:      o,
+		StealthSum: outputKey.PubKey().Sub(inputKey.PubKey()),
+	}
+}
+
+func testRound(tb testing.TB, n int) map[mw.Commitment]*onionEtc {
+	onions := map[mw.Commitment]*onionEtc{}
+	for range n {
+		commit, o := testOnion(tb)
+		onions[commit] = o
+	}
+	return onions
+}
+
+func TestPeelOnions(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	onions := testRound(t, 8)
+	s := &swapService{round: &round{
+		nodes:  []config.Node{{}},
+		onions: maps.Clone(onions),
+	}}
+
+	_, o := testOnion(t)
+	commit := mw.NewCommitment(&mw.BlindingFactor{1}, 1)
+	s.round.onions[*commit] = o
+
+	peeled, outputs := s.peelOnions()
+	if len(peeled) != 8 || len(outputs) != 8 || len(s.round.hops) != 8 {
+		t.Fatal(len(peeled), len(outputs), len(s.round.hops))
+	}
+	if _, ok := s.round.onions[*commit]; ok {
+		t.Fatal("bad onion not dropped")
+	}
+}
+
+func BenchmarkPeelOnions(b *testing.B) {
+	onions := testRound(b, 64)
+	defer func(n int) { workers = n }(workers)
+
+	for n := 1; ; n = min(2*n, runtime.NumCPU()) {
+		b.Run(fmt.Sprint("workers=", n), func(b *testing.B) {
+			workers = n
+			for range b.N {
+				s := &swapService{round: &round{
+					nodes:  []config.Node{{}},
+					onions: maps.Clone(onions),
+				}}
+				s.peelOnions()
+			}
+		})
+		if n == runtime.NumCPU() {
+			break
+		}
+	}
+}
+
+func TestPeelOnionPanic(t *testing.T) {
+	_, o := testOnion(t)
+	commit := mw.NewCommitment(&mw.BlindingFactor{1}, 1)
+	s := &swapService{round: &round{
+		nodes:  []config.Node{{}},
+		onions: map[mw.Commitment]*onionEtc{*commit: {Onion: o.Onion}},
+	}}
+
+	if peeled, _ := s.peelOnions(); len(peeled) != 0 {
+		t.Fatal("onion peeled")
+	}
+	if s.round.diag.Panics != 1 {
+		t.Fatal("panic not counted")
+	}
+}
+
+func TestPeelOnionsDeletes(t *testing.T) {
+	useTestDB(t)
+	if err := initDB(db); err != nil {
+		t.Fatal(err)
+	}
+	// The onions have an output for the last node, but the round has
+	// two nodes, as when the node set changes after they were made.
+	kept, bad := testSignedOnion(t), testSignedOnion(t)
+	bad.Payloads = bad.Payloads[:len(bad.Payloads)-1]
+	s := &swapService{round: &round{
+		nodes:  []config.Node{{}, {}},
+		onions: map[mw.Commitment]*onionEtc{},
+	}}
+	for _, o := range []*onion.Onion{kept, bad} {
+		if err := saveOnion(db, &queuedOnion{Onion: o}); err != nil {
+			t.Fatal(err)
+		}
+		s.round.onions[mw.Commitment(o.Input.Commitment)] = &onionEtc{o, randSecretKey().PubKey()}
+	}
+
+	if peeled, _ := s.peelOnions(); len(peeled) != 0 {
+		t.Fatal("onions peeled")
+	}
+	if found, _ := hasOnion(db, kept.Input.Commitment); !found {
+		t.Fatal("onion deleted for the round's node set")
+	}
+	if found, _ := hasOnion(db, bad.Input.Commitment); found {
+		t.Fatal("malformed onion not deleted")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// syncState describes how far the chain service has caught up. Coins
+// can only be looked up reliably once the MWEB UTXO set has been
+// fetched for the tip, which comes after the headers and filters.
+type syncState struct {
+	Synced       bool   `json:"synced"`
+	Peers        int    `json:"peers"`
+	PeerHeight   int32  `json:"peer_height"`
+	HeaderHeight uint32 `json:"header_height"`
+	FilterHeight uint32 `json:"filter_height"`
+	MwebHeight   uint32 `json:"mweb_height"`
+}
+
+// syncStateTTL is how long the sync state is cached for, as it is
+// checked on every swap_swap.
+const syncStateTTL = 5 * time.Second
+
+var syncCache struct {
+	sync.Mutex
+	st *syncState
+	at time.Time
+}
+
+// cachedSyncState returns the sync state, working it out again once
+// it is older than syncStateTTL.
+func cachedSyncState() (*syncState, error) {
+	syncCache.Lock()
+	defer syncCache.Unlock()
+
+	if syncCache.st != nil && time.Since(syncCache.at) < syncStateTTL {
+		return syncCache.st, nil
+	}
+	st, err := getSyncState()
+	if err != nil {
+		return nil, err
+	}
+	syncCache.st, syncCache.at = st, time.Now()
+	return st, nil
+}
+
+func getSyncState() (*syncState, error) {
+	st := &syncState{Peers: int(cs.ConnectedCount())}
+	for _, peer := range cs.Peers() {
+		st.PeerHeight = max(st.PeerHeight, peer.LastBlock())
+	}
+
+	var err error
+	if _, st.HeaderHeight, err = cs.BlockHeaders.ChainTip(); err != nil {
+		return nil, err
+	}
+	if _, st.FilterHeight, err = cs.RegFilterHeaders.ChainTip(); err != nil {
+		return nil, err
+	}
+	leafset, err := cs.MwebCoinDB.GetLeafset()
+	if err != nil {
+		return nil, err
+	}
+	st.MwebHeight = leafset.Height
+
+	st.Synced = st.Peers > 0 && cs.IsCurrent() &&
+		int64(st.HeaderHeight) >= int64(st.PeerHeight) &&
+		st.MwebHeight >= st.HeaderHeight
+	return st, nil
+}
+
+// reorgGrace is how long after a reorg a coin missing from the coin DB
+// may still come back, as the tx that created it is mined again.
+const reorgGrace = time.Hour
+
+// lastReorg is when a block was last disconnected, in Unix seconds.
+var lastReorg atomic.Int64
+
+// coinsSettled reports whether a coin missing from the coin DB is gone
+// for good: the coin DB has caught up with the header tip, and there
+// hasn't been a reorg lately.
+func coinsSettled() bool {
+	return isSynced() && time.Since(time.Unix(lastReorg.Load(), 0)) > reorgGrace
+}
+
+func isSynced() bool {
+	st, err := cachedSyncState()
+	return err == nil && st.Synced
+}
+
+// waitForSync polls the sync state until it is synced, or until the
+// timeout (if non-zero) has passed.
+func waitForSync(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for logged := false; !isSynced(); logged = true {
+		if timeout > 0 && time.Now().After(deadline) {
+			return false
+		}
+		if !logged {
+			fmt.Println("Waiting for chain sync")
+		}
+		time.Sleep(time.Second)
+	}
+	return true
+}
+
+func (a *adminService) SyncState() (*syncState, error) {
+	return cachedSyncState()
+}
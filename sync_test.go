@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedSyncState(t *testing.T) {
+	defer func() { syncCache.st = nil }()
+	st := &syncState{Synced: true}
+	syncCache.st, syncCache.at = st, time.Now()
+
+	// The chain service isn't running, so this would fail if the
+	// cached state weren't used.
+	if cached, err := cachedSyncState(); err != nil || cached != st {
+		t.Fatal("cached sync state not used", err)
+	}
+	if !isSynced() {
+		t.Fatal("not synced")
+	}
+}
+
+func TestCoinsSettled(t *testing.T) {
+	defer func() { syncCache.st = nil; lastReorg.Store(0) }()
+	syncCache.st, syncCache.at = &syncState{Synced: true}, time.Now()
+	if !coinsSettled() {
+		t.Fatal("coins not settled")
+	}
+	lastReorg.Store(time.Now().Unix())
+	if coinsSettled() {
+		t.Fatal("coins settled right after a reorg")
+	}
+	lastReorg.Store(time.Now().Add(-reorgGrace - time.Second).Unix())
+	syncCache.st = &syncState{}
+	if coinsSettled() {
+		t.Fatal("coins settled while not synced")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/ltcmweb/coinswapd/onion"
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+	"lukechampine.com/blake3"
+)
+
+// Consensus limits on an MWEB block, which also bound a single transaction.
+const (
+	maxMwebWeight = 200_000
+	maxMwebInputs = 50_000
+
+	// minSwapWeight fits a single onion into a round of as many nodes
+	// as an onion can pass through.
+	minSwapWeight = onion.MaxHops*(mweb.StandardOutputWeight+mweb.KernelWithStealthWeight) +
+		mweb.StandardOutputWeight
+)
+
+func mwebTxWeight(txBody *wire.MwebTxBody) (weight uint64) {
+	for _, output := range txBody.Outputs {
+		weight += mweb.BaseOutputWeight
+		if output.Message.Features&wire.MwebOutputMessageStandardFieldsFeatureBit > 0 {
+			weight += mweb.StandardOutputFieldsWeight
+		}
+		weight += extraDataWeight(len(output.Message.ExtraData))
+	}
+	for _, kernel := range txBody.Kernels {
+		weight += mweb.BaseKernelWeight
+		if kernel.Features&wire.MwebKernelStealthExcessFeatureBit > 0 {
+			weight += mweb.StealthExcessWeight
+		}
+		for _, pegout := range kernel.Pegouts {
+			weight += extraDataWeight(len(pegout.PkScript))
+		}
+		weight += extraDataWeight(len(kernel.ExtraData))
+	}
+	for _, input := range txBody.Inputs {
+		weight += extraDataWeight(len(input.ExtraData))
+	}
+	return
+}
+
+// roundCapacity returns how many onions fit into a round's transaction
+// without exceeding the weight, given that every node adds a fee output
+// and a kernel. The entry node fills rounds up to its -w, while the other
+// nodes only hold them to the protocol maximum, as -w may differ.
+func roundCapacity(nNodes int, weight uint64) int {
+	fixed := uint64(nNodes) * (mweb.StandardOutputWeight + mweb.KernelWithStealthWeight)
+	if fixed >= weight {
+		return 0
+	}
+	return int(min((weight-fixed)/mweb.StandardOutputWeight, maxMwebInputs))
+}
+
+func extraDataWeight(n int) uint64 {
+	return (uint64(n) + mweb.BytesPerWeight - 1) / mweb.BytesPerWeight
+}
+
+func verifyKernelSig(kernel *wire.MwebKernel) bool {
+	pubKey := kernel.Excess.PubKey()
+	if kernel.Features&wire.MwebKernelStealthExcessFeatureBit > 0 {
+		h := blake3.New(32, nil)
+		h.Write(pubKey[:])
+		h.Write(kernel.StealthExcess[:])
+		pubKey = pubKey.Mul((*mw.SecretKey)(h.Sum(nil))).Add(&kernel.StealthExcess)
+	}
+	return kernel.Signature.Verify(pubKey, kernel.MessageHash()[:])
+}
+
+// validateTx performs the checks a full node would apply to the
+// final coinswap transaction, so that we never broadcast one that
+// gets rejected (and gets us banned by our peers).
+func validateTx(tx *wire.MwebTx) (err error) {
+	// A panic here is a bug, but it must not take the round down with
+	// it, so it is logged in full and the transaction rejected.
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("validateTx: panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("malformed transaction: %v", r)
+		}
+	}()
+
+	txBody := tx.TxBody
+	if len(txBody.Kernels) == 0 {
+		return errors.New("transaction has no kernels")
+	}
+	if len(txBody.Outputs) == 0 {
+		return errors.New("transaction has no outputs")
+	}
+	if len(txBody.Inputs) > maxMwebInputs {
+		return errors.New("too many inputs")
+	}
+	if weight := mwebTxWeight(txBody); weight > maxMwebWeight {
+		return fmt.Errorf("transaction weight %d exceeds limit", weight)
+	}
+
+	var (
+		commitSum, kernelSum *mw.Commitment
+		stealthSum           *mw.PublicKey
+		stealthExcess        *mw.PublicKey
+		supplyChange         int64
+
+		inputIds = map[chainhash.Hash]bool{}
+		outputs  = map[mw.Commitment]bool{}
+		kernels  = map[chainhash.Hash]bool{}
+	)
+
+	addCommit := func(sum **mw.Commitment, c *mw.Commitment, neg bool) {
+		switch {
+		case *sum == nil:
+			*sum = c
+		case neg:
+			*sum = (*sum).Sub(c)
+		default:
+			*sum = (*sum).Add(c)
+		}
+	}
+	addPubKey := func(sum **mw.PublicKey, pk *mw.PublicKey) {
+		if *sum == nil {
+			*sum = pk
+		} else {
+			*sum = (*sum).Add(pk)
+		}
+	}
+
+	for _, input := range txBody.Inputs {
+		if inputIds[input.OutputId] {
+			return errors.New("duplicate input")
+		}
+		inputIds[input.OutputId] = true
+		if input.InputPubKey == nil {
+			return errors.New("input missing stealth key")
+		}
+		if !input.VerifySig() {
+			return errors.New("verify input sig failed")
+		}
+	}
+
+	for _, output := range txBody.Outputs {
+		if outputs[output.Commitment] {
+			return errors.New("duplicate output")
+		}
+		outputs[output.Commitment] = true
+
+		if output.RangeProof == nil ||
+			output.RangeProofHash != blake3.Sum256(output.RangeProof[:]) {
+			return errors.New("range proof hash mismatch")
+		}
+		var msg bytes.Buffer
+		output.Message.Serialize(&msg)
+		if !output.RangeProof.Verify(output.Commitment, msg.Bytes()) {
+			return errors.New("verify range proof failed")
+		}
+		if !output.VerifySig() {
+			return errors.New("verify output sig failed")
+		}
+
+		addCommit(&commitSum, &output.Commitment, false)
+		addPubKey(&stealthSum, &output.SenderPubKey)
+	}
+
+	for _, input := range txBody.Inputs {
+		addCommit(&commitSum, &input.Commitment, true)
+		addPubKey(&stealthSum, input.InputPubKey)
+		stealthSum = stealthSum.Sub(&input.OutputPubKey)
+	}
+
+	for _, kernel := range txBody.Kernels {
+		hash := *kernel.Hash()
+		if kernels[hash] {
+			return errors.New("duplicate kernel")
+		}
+		kernels[hash] = true
+
+		if !verifyKernelSig(kernel) {
+			return errors.New("verify kernel sig failed")
+		}
+
+		addCommit(&kernelSum, &kernel.Excess, false)
+		if kernel.Features&wire.MwebKernelStealthExcessFeatureBit > 0 {
+			addPubKey(&stealthExcess, &kernel.StealthExcess)
+		}
+		supplyChange += kernel.SupplyChange()
+	}
+
+	if tx.KernelOffset != (mw.BlindingFactor{}) {
+		addCommit(&kernelSum, mw.NewCommitment(&tx.KernelOffset, 0), false)
+	}
+	if supplyChange > 0 {
+		addCommit(&kernelSum, mw.NewCommitment(&mw.BlindingFactor{}, uint64(supplyChange)), false)
+	} else if supplyChange < 0 {
+		addCommit(&kernelSum, mw.NewCommitment(&mw.BlindingFactor{}, uint64(-supplyChange)), true)
+	}
+	if tx.StealthOffset != (mw.BlindingFactor{}) {
+		addPubKey(&stealthExcess, (*mw.SecretKey)(&tx.StealthOffset).PubKey())
+	}
+
+	if *commitSum != *kernelSum {
+		return errors.New("kernel sum mismatch")
+	}
+	if stealthExcess == nil || *stealthSum != *stealthExcess {
+		return errors.New("stealth sum mismatch")
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/ltcmweb/ltcd/chaincfg/chainhash"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb"
+	"github.com/ltcmweb/ltcd/ltcutil/mweb/mw"
+	"github.com/ltcmweb/ltcd/wire"
+)
+
+func randSecretKey() *mw.SecretKey {
+	k := &mw.SecretKey{}
+	rand.Read(k[:])
+	return k
+}
+
+func testTx(t *testing.T) *wire.MwebTx {
+	keychain := &mweb.Keychain{Scan: randSecretKey(), Spend: randSecretKey()}
+	coin := &mweb.Coin{
+		SpendKey: randSecretKey(),
+		Blind:    (*mw.BlindingFactor)(randSecretKey()),
+		Value:    100000,
+		OutputId: &chainhash.Hash{1},
+	}
+	tx, _, err := mweb.NewTransaction([]*mweb.Coin{coin},
+		[]*mweb.Recipient{{Value: 90000, Address: keychain.Address(0)}},
+		10000, 0, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestValidateTx(t *testing.T) {
+	tx := testTx(t)
+	if err := validateTx(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	tx.KernelOffset[31]++
+	if validateTx(tx) == nil {
+		t.Fatal("expected kernel sum mismatch")
+	}
+	tx.KernelOffset[31]--
+
+	tx.StealthOffset[31]++
+	if validateTx(tx) == nil {
+		t.Fatal("expected stealth sum mismatch")
+	}
+	tx.StealthOffset[31]--
+
+	tx.TxBody.Inputs = append(tx.TxBody.Inputs, tx.TxBody.Inputs[0])
+	if validateTx(tx) == nil {
+		t.Fatal("expected duplicate input")
+	}
+	tx.TxBody.Inputs = tx.TxBody.Inputs[:1]
+
+	tx.TxBody.Kernels[0].Fee++
+	if validateTx(tx) == nil {
+		t.Fatal("expected kernel sig failure")
+	}
+}
+
+func TestRoundCapacity(t *testing.T) {
+	weight := func(nOnions, nNodes int) uint64 {
+		return uint64(nOnions+nNodes)*mweb.StandardOutputWeight +
+			uint64(nNodes)*mweb.KernelWithStealthWeight
+	}
+	for nNodes := 1; nNodes < 10; nNodes++ {
+		n := roundCapacity(nNodes, *maxWeight)
+		if weight(n, nNodes) > *maxWeight || weight(n+1, nNodes) <= *maxWeight {
+			t.Fatal(nNodes, n)
+		}
+	}
+	if roundCapacity(1, maxMwebWeight) <= roundCapacity(1, *maxWeight) {
+		t.Fatal("protocol maximum not above the default -w")
+	}
+}